@@ -0,0 +1,62 @@
+// Command export writes the live quotes in quotebox to a fortune, CSV, JSON
+// Lines or Markdown file, which can be read back in with the import command.
+//
+// Usage:
+//
+//	export [-user 1] [-format csv] [-o quotes.csv]
+//
+// Without -user every user's quotes are exported. The file is written to
+// standard output if no -o is given.
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"cb.net/snippetbox/pkg/models/mysql"
+	"cb.net/snippetbox/pkg/quotefile"
+
+	_ "github.com/go-sql-driver/mysql"
+)
+
+func main() {
+	dsn := flag.String("dsn", "web:P@ssw0rd@/snippetbox?parseTime=true", "MySQL data source name")
+	userID := flag.Int("user", 0, "Only export the quotes of the user with this ID")
+	format := flag.String("format", "", "File format: "+strings.Join(quotefile.Formats, ", ")+" (guessed from the -o file name if not given)")
+	output := flag.String("o", "", "File to write to (default standard output)")
+	flag.Parse()
+
+	errorLog := log.New(os.Stderr, "", 0)
+	if *format == "" {
+		*format = quotefile.FormatForFile(*output)
+	}
+
+	db, err := sql.Open("mysql", *dsn)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+	defer db.Close()
+
+	snippets, err := (&mysql.SnippetModel{DB: db}).Export(*userID)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			errorLog.Fatal(err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	if err = quotefile.Write(out, *format, snippets); err != nil {
+		errorLog.Fatal(err)
+	}
+}
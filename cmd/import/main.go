@@ -0,0 +1,99 @@
+// Command import adds quotes to quotebox from a fortune, CSV, JSON Lines or
+// Markdown file. Every quote is checked with the same rules as the create
+// snippet form, and nothing is added unless every quote in the file is
+// valid, in which case they are all inserted in a single transaction.
+//
+// Usage:
+//
+//	import -user 1 [-format csv] [-visibility public] [-expires never] quotes.csv
+//
+// The file is read from standard input if no name is given.
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+
+	"cb.net/snippetbox/pkg/models"
+	"cb.net/snippetbox/pkg/models/mysql"
+	"cb.net/snippetbox/pkg/quotefile"
+
+	_ "github.com/go-sql-driver/mysql"
+)
+
+func main() {
+	dsn := flag.String("dsn", "web:P@ssw0rd@/snippetbox?parseTime=true", "MySQL data source name")
+	userID := flag.Int("user", 0, "ID of the user who will own the imported quotes")
+	format := flag.String("format", "", "File format: "+strings.Join(quotefile.Formats, ", ")+" (guessed from the file name if not given)")
+	visibility := flag.String("visibility", models.VisibilityPublic, "Visibility of quotes which don't specify one")
+	expires := flag.String("expires", "never", "Expiry of quotes which don't specify one: 1, 7 or 365 days, or never")
+	dryRun := flag.Bool("n", false, "Check the file without importing anything")
+	flag.Parse()
+
+	errorLog := log.New(os.Stderr, "", 0)
+	if *userID < 1 {
+		errorLog.Fatal("import: -user is required")
+	}
+
+	var in io.Reader = os.Stdin
+	name := "stdin"
+	if flag.NArg() > 0 {
+		name = flag.Arg(0)
+		f, err := os.Open(name)
+		if err != nil {
+			errorLog.Fatal(err)
+		}
+		defer f.Close()
+		in = f
+	}
+	if *format == "" {
+		*format = quotefile.FormatForFile(name)
+	}
+
+	records, err := quotefile.Read(in, *format)
+	if err != nil {
+		errorLog.Fatalf("%s: %s", name, err)
+	}
+
+	snippets, errs := quotefile.Snippets(records, url.Values{
+		"visibility": {*visibility},
+		"expires":    {*expires},
+	})
+	if errs != nil {
+		for _, err := range errs {
+			errorLog.Printf("%s: %s", name, err)
+		}
+		errorLog.Fatalf("%s: %d of %d quotes are invalid; nothing was imported", name, len(errs), len(records))
+	}
+	if *dryRun {
+		fmt.Printf("%s: %d quotes are ready to import\n", name, len(snippets))
+		return
+	}
+
+	db, err := sql.Open("mysql", *dsn)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := (&mysql.UserModel{DB: db}).Get(*userID); err == models.ErrNoRecord {
+		errorLog.Fatalf("import: there is no user with ID %d", *userID)
+	} else if err != nil {
+		errorLog.Fatal(err)
+	}
+
+	for _, s := range snippets {
+		s.UserID = *userID
+	}
+	ids, err := (&mysql.SnippetModel{DB: db}).InsertMany(snippets)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+	fmt.Printf("%s: imported %d quotes\n", name, len(ids))
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"cb.net/snippetbox/pkg/forms"
+	"cb.net/snippetbox/pkg/models"
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// apiSnippet is the JSON representation of a snippet returned by the API.
+// Expires is null for snippets that never expire.
+type apiSnippet struct {
+	ID         int        `json:"id"`
+	Title      string     `json:"title"`
+	Content    string     `json:"content"`
+	Author     *apiAuthor `json:"author"`
+	Source     string     `json:"source"`
+	Year       int        `json:"year,omitempty"`
+	Tags       []string   `json:"tags,omitempty"`
+	Visibility string     `json:"visibility"`
+	PostedBy   string     `json:"posted_by,omitempty"`
+	Created    time.Time  `json:"created"`
+	Updated    time.Time  `json:"updated"`
+	Expires    *time.Time `json:"expires"`
+}
+
+// apiAuthor is the JSON representation of an author.
+type apiAuthor struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	Born int    `json:"born,omitempty"`
+	Died int    `json:"died,omitempty"`
+	Bio  string `json:"bio,omitempty"`
+}
+
+func newAPISnippet(s *models.Snippet) *apiSnippet {
+	out := &apiSnippet{
+		ID:         s.ID,
+		Title:      s.Title,
+		Content:    s.Content,
+		Source:     s.Source,
+		Year:       s.Year,
+		Tags:       s.Tags,
+		Visibility: s.Visibility,
+		PostedBy:   s.UserName,
+		Created:    s.Created,
+		Updated:    s.Updated,
+	}
+	if a := s.Author; a != nil {
+		out.Author = &apiAuthor{ID: a.ID, Name: a.Name, Born: a.Born, Died: a.Died, Bio: a.Bio}
+	}
+	if !s.Expires.IsZero() {
+		out.Expires = &s.Expires
+	}
+	return out
+}
+
+// apiSnippetInput is the JSON body accepted when creating or updating a
+// snippet. Its fields mirror the inputs of the HTML snippet forms, and it is
+// converted to form values so that exactly the same validation rules apply.
+// Expires and ExpiresAt are ignored on update.
+type apiSnippetInput struct {
+	Title      string   `json:"title"`
+	Content    string   `json:"content"`
+	Author     string   `json:"author"`
+	AuthorBorn int      `json:"author_born"`
+	AuthorDied int      `json:"author_died"`
+	AuthorBio  string   `json:"author_bio"`
+	Source     string   `json:"source"`
+	Year       int      `json:"year"`
+	Tags       []string `json:"tags"`
+	Visibility string   `json:"visibility"`
+	Expires    string   `json:"expires"`
+	ExpiresAt  string   `json:"expires_at"`
+}
+
+// form converts the input to a form, filling in the same defaults that the
+// HTML create form pre-selects. A missing visibility is set to visibility,
+// which is public for new snippets but must be the existing setting for
+// updates, so that leaving it out never makes a private snippet public.
+func (in *apiSnippetInput) form(visibility string) *forms.Form {
+	itoa := func(n int) string {
+		if n == 0 {
+			return ""
+		}
+		return strconv.Itoa(n)
+	}
+	data := url.Values{}
+	data.Set("title", in.Title)
+	data.Set("content", in.Content)
+	data.Set("author", in.Author)
+	data.Set("author_born", itoa(in.AuthorBorn))
+	data.Set("author_died", itoa(in.AuthorDied))
+	data.Set("author_bio", in.AuthorBio)
+	data.Set("source", in.Source)
+	data.Set("year", itoa(in.Year))
+	data.Set("tags", strings.Join(in.Tags, ","))
+	data.Set("visibility", in.Visibility)
+	if in.Visibility == "" {
+		data.Set("visibility", visibility)
+	}
+	data.Set("expires", in.Expires)
+	if in.Expires == "" {
+		data.Set("expires", "365")
+	}
+	data.Set("expires_at", in.ExpiresAt)
+	return forms.New(data)
+}
+
+func (app *application) apiListSnippets(w http.ResponseWriter, r *http.Request) {
+	p, err := app.page(r)
+	if err != nil {
+		app.apiError(w, http.StatusBadRequest, "invalid cursor")
+		return
+	}
+
+	page, err := app.snippets.Latest(p)
+	if err != nil {
+		app.apiServerError(w, err)
+		return
+	}
+
+	out := struct {
+		Snippets []*apiSnippet `json:"snippets"`
+		Prev     string        `json:"prev,omitempty"`
+		Next     string        `json:"next,omitempty"`
+	}{Snippets: []*apiSnippet{}}
+	for _, s := range page.Snippets {
+		out.Snippets = append(out.Snippets, newAPISnippet(s))
+	}
+	if page.Prev != nil {
+		out.Prev = page.Prev.String()
+	}
+	if page.Next != nil {
+		out.Next = page.Next.String()
+	}
+	app.writeJSON(w, http.StatusOK, out)
+}
+
+func (app *application) apiShowSnippet(w http.ResponseWriter, r *http.Request) {
+	s, ok := app.apiSnippet(w, r)
+	if !ok {
+		return
+	}
+	app.writeJSON(w, http.StatusOK, newAPISnippet(s))
+}
+
+func (app *application) apiCreateSnippet(w http.ResponseWriter, r *http.Request) {
+	var in apiSnippetInput
+	if !app.readJSON(w, r, &in) {
+		return
+	}
+
+	form := in.form(models.VisibilityPublic)
+	forms.ValidateNewSnippet(form)
+	if !form.Valid() {
+		app.writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{"errors": form.Errors})
+		return
+	}
+
+	snippet := forms.Snippet(form)
+	err := app.resolveAuthor(snippet)
+	if err != nil {
+		app.apiServerError(w, err)
+		return
+	}
+	snippet.Expires = forms.ExpiryTime(form)
+	snippet.UserID = app.authenticatedUser(r).ID
+	id, err := app.snippets.Insert(snippet)
+	if err != nil {
+		app.apiServerError(w, err)
+		return
+	}
+
+	s, err := app.snippets.Get(id)
+	if err != nil {
+		app.apiServerError(w, err)
+		return
+	}
+	app.snippetEvent(r, models.EventSnippetCreated, s)
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/snippets/%d", id))
+	app.writeJSON(w, http.StatusCreated, newAPISnippet(s))
+}
+
+func (app *application) apiUpdateSnippet(w http.ResponseWriter, r *http.Request) {
+	s, ok := app.apiSnippet(w, r)
+	if !ok {
+		return
+	}
+	if !app.canModify(r, s) {
+		app.apiError(w, http.StatusForbidden, http.StatusText(http.StatusForbidden))
+		return
+	}
+
+	var in apiSnippetInput
+	if !app.readJSON(w, r, &in) {
+		return
+	}
+
+	form := in.form(s.Visibility)
+	forms.ValidateSnippet(form)
+	if !form.Valid() {
+		app.writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{"errors": form.Errors})
+		return
+	}
+
+	updated := forms.Snippet(form)
+	err := app.resolveAuthor(updated)
+	if err != nil {
+		app.apiServerError(w, err)
+		return
+	}
+	updated.ID = s.ID
+	err = app.snippets.Update(updated, app.authenticatedUser(r).ID)
+	if err == models.ErrNoRecord {
+		app.apiError(w, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		return
+	} else if err != nil {
+		app.apiServerError(w, err)
+		return
+	}
+
+	s, err = app.snippets.Get(s.ID)
+	if err != nil {
+		app.apiServerError(w, err)
+		return
+	}
+	app.snippetEvent(r, models.EventSnippetUpdated, s)
+	app.writeJSON(w, http.StatusOK, newAPISnippet(s))
+}
+
+func (app *application) apiDeleteSnippet(w http.ResponseWriter, r *http.Request) {
+	s, ok := app.apiSnippet(w, r)
+	if !ok {
+		return
+	}
+	if !app.canModify(r, s) {
+		app.apiError(w, http.StatusForbidden, http.StatusText(http.StatusForbidden))
+		return
+	}
+
+	err := app.snippets.Delete(s.ID)
+	if err != nil && err != models.ErrNoRecord {
+		app.apiServerError(w, err)
+		return
+	}
+	app.snippetEvent(r, models.EventSnippetDeleted, s)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiSnippet is the API counterpart of viewableSnippet. It fetches the
+// snippet named in the URL, sending a JSON error response and returning
+// false if there isn't one or the current user isn't allowed to see it.
+func (app *application) apiSnippet(w http.ResponseWriter, r *http.Request) (*models.Snippet, bool) {
+	id, err := strconv.Atoi(r.URL.Query().Get(":id"))
+	if err != nil || id < 1 {
+		app.apiError(w, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		return nil, false
+	}
+
+	s, err := app.snippets.Get(id)
+	if err == models.ErrNoRecord || (err == nil && !app.canView(r, s, false)) {
+		app.apiError(w, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		return nil, false
+	} else if err != nil {
+		app.apiServerError(w, err)
+		return nil, false
+	}
+	return s, true
+}
+
+// requireAPIAuthentication is the API counterpart of requireAuthentication.
+// Rather than redirecting to the login page it sends a 401 JSON response.
+func (app *application) requireAPIAuthentication(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.isAuthenticated(r) {
+			app.apiError(w, http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authenticateToken is the API counterpart of authenticate. If the request
+// carries an "Authorization: Bearer" header it authenticates the token, which
+// may be a personal access token or a signed token from apiIssueToken, and
+// places the token's owner and scope into the request context. Requests with
+// a missing or unusable token are rejected rather than treated as anonymous,
+// so that scripts find out straight away that their token is bad.
+func (app *application) authenticateToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		if header == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		fields := strings.Fields(header)
+		if len(fields) != 2 || !strings.EqualFold(fields[0], "Bearer") {
+			app.invalidToken(w)
+			return
+		}
+
+		userID, scope, err := app.bearerToken(fields[1])
+		if err == models.ErrNoRecord {
+			app.invalidToken(w)
+			return
+		} else if err != nil {
+			app.apiServerError(w, err)
+			return
+		}
+
+		user, err := app.users.Get(userID)
+		if err != nil && err != models.ErrNoRecord {
+			app.apiServerError(w, err)
+			return
+		} else if err == models.ErrNoRecord || !user.Active {
+			app.invalidToken(w)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), contextKeyIsAuthenticated, true)
+		ctx = context.WithValue(ctx, contextKeyUser, user)
+		ctx = context.WithValue(ctx, contextKeyScope, scope)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// bearerToken returns the user ID and scope for a bearer token. Signed
+// tokens are recognised by their three dot-separated parts; anything else is
+// looked up as a personal access token. It returns models.ErrNoRecord if the
+// token is invalid, expired or revoked.
+func (app *application) bearerToken(token string) (int, string, error) {
+	if strings.Count(token, ".") != 2 {
+		t, err := app.tokens.Authenticate(token)
+		if err != nil {
+			return 0, "", err
+		}
+		return t.UserID, t.Scope, nil
+	}
+
+	claims := &apiClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		if t.Method != jwt.SigningMethodHS256 {
+			return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+		}
+		return app.jwtKey, nil
+	})
+	if err != nil || !claims.VerifyIssuer(jwtIssuer, true) {
+		return 0, "", models.ErrNoRecord
+	}
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return 0, "", models.ErrNoRecord
+	}
+	return userID, claims.Scope, nil
+}
+
+// invalidToken sends the 401 response for a bad bearer token.
+func (app *application) invalidToken(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	app.apiError(w, http.StatusUnauthorized, "invalid or expired token")
+}
+
+// requireScope returns middleware which rejects requests authenticated with
+// a token that hasn't been granted the given scope. A write token may also
+// be used to read. Requests authenticated by a session cookie are not
+// restricted.
+func (app *application) requireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			granted, ok := r.Context().Value(contextKeyScope).(string)
+			if ok && granted != scope && granted != models.ScopeWrite {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, scope))
+				app.apiError(w, http.StatusForbidden, fmt.Sprintf("token lacks the %s scope", scope))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// jwtIssuer is the issuer claim of the signed tokens made by apiIssueToken.
+const jwtIssuer = "quotebox"
+
+// apiClaims are the claims carried by a signed API token. The subject is
+// the user's ID.
+type apiClaims struct {
+	Scope string `json:"scope"`
+	jwt.StandardClaims
+}
+
+// jwtKey derives the key used to sign API tokens from the application
+// secret, so that the session key itself is never used for anything else.
+func jwtKey(secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("api token signing key"))
+	return mac.Sum(nil)
+}
+
+// apiIssueToken exchanges the caller's credentials for a signed token which
+// expires after app.jwtLifetime. Signed tokens are checked without a database
+// lookup, so they can't be revoked; keeping their lifetime short limits the
+// damage if one leaks. The token carries the scope of the credentials used to
+// obtain it.
+//
+// A session cookie is enough to ask for a token, so the request must have a
+// JSON body, which may be just {}, like every other API request that
+// changes something. Otherwise any site could have a logged in user's
+// browser post a form here and mint a token for them.
+func (app *application) apiIssueToken(w http.ResponseWriter, r *http.Request) {
+	var input struct{}
+	if !app.readJSON(w, r, &input) {
+		return
+	}
+
+	scope, ok := r.Context().Value(contextKeyScope).(string)
+	if !ok {
+		scope = models.ScopeWrite
+	}
+
+	now := time.Now().UTC()
+	expires := now.Add(app.jwtLifetime)
+	claims := &apiClaims{
+		Scope: scope,
+		StandardClaims: jwt.StandardClaims{
+			Subject:   strconv.Itoa(app.authenticatedUser(r).ID),
+			Issuer:    jwtIssuer,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: expires.Unix(),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(app.jwtKey)
+	if err != nil {
+		app.apiServerError(w, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"token":   token,
+		"scope":   scope,
+		"expires": expires,
+	})
+}
+
+// readJSON decodes a JSON request body of at most 4096 bytes into dst. The
+// API sits outside the CSRF middleware, so requests must declare a JSON
+// content type: browsers won't send one cross-origin without a CORS
+// preflight, which we never approve. On failure it sends an error response
+// and returns false.
+func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst interface{}) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		app.apiError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/json")
+		return false
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 4096)
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		app.apiError(w, http.StatusBadRequest, fmt.Sprintf("invalid JSON body: %s", err))
+		return false
+	}
+	return true
+}
+
+// writeJSON sends v as a JSON response with the given status code.
+func (app *application) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		app.apiServerError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(js, '\n'))
+}
+
+// apiError sends a JSON error response with the given status and message.
+func (app *application) apiError(w http.ResponseWriter, status int, message string) {
+	app.writeJSON(w, status, map[string]string{"error": message})
+}
+
+// apiServerError is the API counterpart of serverError. It logs the error
+// and stack trace and sends a generic 500 JSON response.
+func (app *application) apiServerError(w http.ResponseWriter, err error) {
+	trace := fmt.Sprintf("%s\n%s", err.Error(), debug.Stack())
+	app.errorLog.Output(2, trace)
+
+	app.apiError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"cb.net/snippetbox/pkg/models"
+)
+
+func TestAPISnippetInputVisibility(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      string
+		visibility string
+		want       string
+	}{
+		{"Create without visibility", "", models.VisibilityPublic, models.VisibilityPublic},
+		{"Create as private", models.VisibilityPrivate, models.VisibilityPublic, models.VisibilityPrivate},
+		{"Update private without visibility", "", models.VisibilityPrivate, models.VisibilityPrivate},
+		{"Update unlisted without visibility", "", models.VisibilityUnlisted, models.VisibilityUnlisted},
+		{"Update private to public", models.VisibilityPublic, models.VisibilityPrivate, models.VisibilityPublic},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := &apiSnippetInput{Title: "T", Content: "C", Author: "A", Visibility: tt.input}
+			got := in.form(tt.visibility).Get("visibility")
+			if got != tt.want {
+				t.Errorf("want %q; got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestAPIIssueToken(t *testing.T) {
+	app := &application{jwtKey: []byte("test key"), jwtLifetime: time.Minute}
+	user := &models.User{ID: 5, Active: true}
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		wantCode    int
+	}{
+		{"JSON body", "application/json", "{}", http.StatusCreated},
+		{"JSON with charset", "application/json; charset=utf-8", "{}", http.StatusCreated},
+		{"Cross-site form post", "application/x-www-form-urlencoded", "a=b", http.StatusUnsupportedMediaType},
+		{"Plain text", "text/plain", "{}", http.StatusUnsupportedMediaType},
+		{"No body", "application/json", "", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/api/v1/token", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			r = r.WithContext(context.WithValue(r.Context(), contextKeyUser, user))
+			rr := httptest.NewRecorder()
+			app.apiIssueToken(rr, r)
+
+			if rr.Code != tt.wantCode {
+				t.Errorf("want %d; got %d: %s", tt.wantCode, rr.Code, rr.Body)
+			}
+			if tt.wantCode == http.StatusCreated && !strings.Contains(rr.Body.String(), `"token":`) {
+				t.Errorf("want a token; got %s", rr.Body)
+			}
+		})
+	}
+}
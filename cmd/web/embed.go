@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+
+	"cb.net/snippetbox/pkg/models"
+)
+
+// The default and minimum sizes, in pixels, of the iframe suggested by the
+// oEmbed endpoint.
+const (
+	embedWidth     = 500
+	embedHeight    = 220
+	embedMinWidth  = 200
+	embedMinHeight = 120
+)
+
+// embedPathRX matches the paths of the quote pages which can be embedded,
+// capturing either the quote's ID or its share link slug.
+var embedPathRX = regexp.MustCompile(`^/(?:snippet/([0-9]+)|s/([A-Za-z0-9_-]{22}))/?$`)
+
+func (app *application) embedSnippet(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get(":id"))
+	if err != nil || id < 1 {
+		app.notFound(w)
+		return
+	}
+	s, err := app.snippets.Get(id)
+	app.renderEmbed(w, r, s, err, false)
+}
+
+func (app *application) embedSharedSnippet(w http.ResponseWriter, r *http.Request) {
+	s, err := app.snippets.GetBySlug(r.URL.Query().Get(":slug"))
+	app.renderEmbed(w, r, s, err, true)
+}
+
+// renderEmbed writes the standalone card for an embedded snippet, given the
+// result of looking it up. Embeds are served outside the session middleware
+// so that they show the same thing wherever they're framed: public quotes,
+// and unlisted ones reached through their share link. The global
+// X-Frame-Options header is replaced by a CSP that lets any site frame the
+// card while stopping it from loading anything but our own stylesheet.
+func (app *application) renderEmbed(w http.ResponseWriter, r *http.Request, s *models.Snippet, err error, viaSlug bool) {
+	if err == models.ErrNoRecord || (err == nil && !embeddable(s, viaSlug)) {
+		app.notFound(w)
+		return
+	} else if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	// Embeds can't use the render helper, as addDefaultData relies on the
+	// session.
+	buf := new(bytes.Buffer)
+	err = app.templateCache["embed.page.tmpl"].Execute(buf, &templateData{Snippet: s})
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	w.Header().Del("X-Frame-Options")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'self'; base-uri 'none'; form-action 'none'; frame-ancestors *")
+	buf.WriteTo(w)
+}
+
+// oembedResponse is a "rich" type oEmbed response, as described at
+// https://oembed.com/.
+type oembedResponse struct {
+	Version      string `json:"version"`
+	Type         string `json:"type"`
+	Title        string `json:"title"`
+	AuthorName   string `json:"author_name,omitempty"`
+	AuthorURL    string `json:"author_url,omitempty"`
+	ProviderName string `json:"provider_name"`
+	ProviderURL  string `json:"provider_url"`
+	HTML         string `json:"html"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+}
+
+// oembed lets tools which support oEmbed turn a link to a quote into an
+// embedded card. Only JSON responses are supported, as the specification
+// allows.
+func (app *application) oembed(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if format := q.Get("format"); format != "" && format != "json" {
+		app.apiError(w, http.StatusNotImplemented, "only the json format is supported")
+		return
+	}
+
+	base := app.baseURL(r)
+	target, err := url.Parse(q.Get("url"))
+	if err != nil || target.Host != base.Host {
+		app.apiError(w, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		return
+	}
+	m := embedPathRX.FindStringSubmatch(target.Path)
+	if m == nil {
+		app.apiError(w, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		return
+	}
+
+	var s *models.Snippet
+	viaSlug := m[2] != ""
+	if viaSlug {
+		s, err = app.snippets.GetBySlug(m[2])
+	} else {
+		var id int
+		id, err = strconv.Atoi(m[1])
+		if err != nil {
+			app.apiError(w, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+			return
+		}
+		s, err = app.snippets.Get(id)
+	}
+	if err == models.ErrNoRecord || (err == nil && !embeddable(s, viaSlug)) {
+		app.apiError(w, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		return
+	} else if err != nil {
+		app.apiServerError(w, err)
+		return
+	}
+
+	width := oembedSize(q.Get("maxwidth"), embedWidth, embedMinWidth)
+	height := oembedSize(q.Get("maxheight"), embedHeight, embedMinHeight)
+	if width == 0 || height == 0 {
+		app.apiError(w, http.StatusNotFound, "maxwidth or maxheight is too small")
+		return
+	}
+
+	src := fmt.Sprintf("/snippet/%d/embed", s.ID)
+	if viaSlug {
+		src = fmt.Sprintf("/s/%s/embed", s.Slug)
+	}
+	out := &oembedResponse{
+		Version:      "1.0",
+		Type:         "rich",
+		Title:        s.Title,
+		ProviderName: "Quotebox",
+		ProviderURL:  base.ResolveReference(&url.URL{Path: "/"}).String(),
+		HTML: fmt.Sprintf(`<iframe src="%s" width="%d" height="%d" frameborder="0" title="%s"></iframe>`,
+			html.EscapeString(base.ResolveReference(&url.URL{Path: src}).String()), width, height, html.EscapeString(s.Title)),
+		Width:  width,
+		Height: height,
+	}
+	if a := s.Author; a != nil {
+		out.AuthorName = a.Name
+		out.AuthorURL = base.ResolveReference(&url.URL{Path: fmt.Sprintf("/author/%d", a.ID)}).String()
+	}
+	app.writeJSON(w, http.StatusOK, out)
+}
+
+// embeddable reports whether a snippet may be embedded: that is, whether an
+// anonymous visitor could see it. Private quotes are never embeddable, even
+// by their owner, as the embed will be seen by other people.
+func embeddable(s *models.Snippet, viaSlug bool) bool {
+	return s.Visibility == models.VisibilityPublic ||
+		(viaSlug && s.Visibility == models.VisibilityUnlisted)
+}
+
+// oembedSize returns the default size, reduced to the consumer's maximum if
+// it gave one. It returns zero if the maximum is smaller than the minimum
+// size the card can be shown at.
+func oembedSize(max string, def, min int) int {
+	n, err := strconv.Atoi(max)
+	if err != nil || n <= 0 || n >= def {
+		return def
+	}
+	if n < min {
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"cb.net/snippetbox/pkg/models"
+)
+
+// eventHistory is how many recent events the broadcaster keeps, so that a
+// client which reconnects with a Last-Event-ID header can catch up on what
+// it missed.
+const eventHistory = 50
+
+// sseEvent is a single server-sent event. IDs are the IDs of the snippets
+// the events describe, so they only ever increase.
+type sseEvent struct {
+	ID   int
+	Name string
+	Data []byte
+}
+
+// broadcaster fans events out to every open /events stream in this process.
+// Each stream has a small buffer; a stream which falls behind is closed
+// rather than allowed to hold up the others, and its client reconnects and
+// catches up from the history.
+type broadcaster struct {
+	mu      sync.Mutex
+	streams map[chan *sseEvent]struct{}
+	history []*sseEvent
+	closed  bool
+}
+
+func newBroadcaster() *broadcaster {
+	return &broadcaster{streams: make(map[chan *sseEvent]struct{})}
+}
+
+// publish sends an event to every open stream.
+func (b *broadcaster) publish(e *sseEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+
+	b.history = append(b.history, e)
+	if len(b.history) > eventHistory {
+		b.history = b.history[len(b.history)-eventHistory:]
+	}
+
+	for ch := range b.streams {
+		select {
+		case ch <- e:
+		default:
+			delete(b.streams, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe opens a new stream. It returns the events published since
+// lastID, if any, and false if the broadcaster has been closed.
+func (b *broadcaster) subscribe(lastID int) (chan *sseEvent, []*sseEvent, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, nil, false
+	}
+
+	var missed []*sseEvent
+	if lastID > 0 {
+		for _, e := range b.history {
+			if e.ID > lastID {
+				missed = append(missed, e)
+			}
+		}
+	}
+
+	ch := make(chan *sseEvent, 16)
+	b.streams[ch] = struct{}{}
+	return ch, missed, true
+}
+
+// unsubscribe closes a stream, unless publish or close already has.
+func (b *broadcaster) unsubscribe(ch chan *sseEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.streams[ch]; ok {
+		delete(b.streams, ch)
+		close(ch)
+	}
+}
+
+// close ends every open stream and refuses new ones. It is registered with
+// http.Server.RegisterOnShutdown, as Shutdown would otherwise wait for the
+// streams, which never go idle, until its timeout ran out.
+func (b *broadcaster) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for ch := range b.streams {
+		delete(b.streams, ch)
+		close(ch)
+	}
+}
+
+// liveSnippet is the data of a "snippet" event, holding just what the home
+// page needs to add a row to its table.
+type liveSnippet struct {
+	ID      int        `json:"id"`
+	Title   string     `json:"title"`
+	Author  *apiAuthor `json:"author"`
+	Created string     `json:"created"`
+}
+
+// publishSnippet tells the home pages open in browsers about a newly
+// created public snippet.
+func (app *application) publishSnippet(s *models.Snippet) {
+	data, err := json.Marshal(&liveSnippet{
+		ID:      s.ID,
+		Title:   s.Title,
+		Author:  newAPISnippet(s).Author,
+		Created: humanDate(s.Created),
+	})
+	if err != nil {
+		app.errorLog.Print(err)
+		return
+	}
+	app.broadcaster.publish(&sseEvent{ID: s.ID, Name: "snippet", Data: data})
+}
+
+// events streams newly created public snippets to the home page as
+// server-sent events. A comment is sent every heartbeat interval so that
+// proxies don't time the connection out, and browsers reconnect by
+// themselves with a Last-Event-ID header if the stream drops.
+func (app *application) events(w http.ResponseWriter, r *http.Request) {
+	lastID, _ := strconv.Atoi(r.Header.Get("Last-Event-ID"))
+	ch, missed, ok := app.broadcaster.subscribe(lastID)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	defer app.broadcaster.unsubscribe(ch)
+
+	// The server's WriteTimeout applies to the whole response, which would
+	// cut every stream off after a few seconds. Instead, each write gets its
+	// own deadline, long enough to cover the wait for the next heartbeat.
+	rc := http.NewResponseController(w)
+	write := func(format string, args ...interface{}) error {
+		err := rc.SetWriteDeadline(time.Now().Add(2 * app.eventHeartbeat))
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, format, args...)
+		if err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	// Ask browsers to wait a few seconds before reconnecting, so that a
+	// restart isn't met by every open page at once.
+	err := write("retry: 5000\n\n")
+	if err != nil {
+		app.errorLog.Print(err)
+		return
+	}
+	for _, e := range missed {
+		if write("id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Name, e.Data) != nil {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(app.eventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			err = write("id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Name, e.Data)
+		case <-heartbeat.C:
+			err = write(": heartbeat\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newEventsServer() (*application, *httptest.Server) {
+	app := &application{
+		broadcaster:    newBroadcaster(),
+		errorLog:       log.New(ioutil.Discard, "", 0),
+		eventHeartbeat: 50 * time.Millisecond,
+	}
+	return app, httptest.NewServer(http.HandlerFunc(app.events))
+}
+
+// openStream requests the event stream and returns a function which reads
+// it up to the end of the next event.
+func openStream(t *testing.T, ctx context.Context, url, lastID string) (*http.Response, func() string) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(ctx)
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(resp.Body)
+	next := func() string {
+		var event []string
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				t.Fatalf("reading stream: %v", err)
+			}
+			if line == "\n" {
+				return strings.Join(event, "")
+			}
+			event = append(event, line)
+		}
+	}
+	return resp, next
+}
+
+// count returns how many streams the broadcaster has open.
+func (b *broadcaster) count() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.streams)
+}
+
+// waitFor polls cond for up to a few seconds.
+func waitFor(cond func() bool) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+func TestEvents(t *testing.T) {
+	app, ts := newEventsServer()
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resp, next := openStream(t, ctx, ts.URL, "")
+	defer resp.Body.Close()
+
+	if got := resp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("want Content-Type text/event-stream; got %q", got)
+	}
+	if got := next(); got != "retry: 5000\n" {
+		t.Errorf("want retry first; got %q", got)
+	}
+
+	app.broadcaster.publish(&sseEvent{ID: 3, Name: "snippet", Data: []byte(`{"id":3}`)})
+	want := "id: 3\nevent: snippet\ndata: {\"id\":3}\n"
+	// A heartbeat may come first.
+	got := next()
+	if got == ": heartbeat\n" {
+		got = next()
+	}
+	if got != want {
+		t.Errorf("want event %q; got %q", want, got)
+	}
+
+	// The heartbeat comes round while nothing else is happening.
+	if got := next(); got != ": heartbeat\n" {
+		t.Errorf("want a heartbeat; got %q", got)
+	}
+
+	// When the client goes away the handler returns and the stream is
+	// closed.
+	cancel()
+	if !waitFor(func() bool { return app.broadcaster.count() == 0 }) {
+		t.Error("stream still open after the client went away")
+	}
+}
+
+func TestEventsCatchUp(t *testing.T) {
+	app, ts := newEventsServer()
+	defer ts.Close()
+	for id := 1; id <= 3; id++ {
+		app.broadcaster.publish(&sseEvent{ID: id, Name: "snippet", Data: []byte("{}")})
+	}
+
+	resp, next := openStream(t, context.Background(), ts.URL, "1")
+	defer resp.Body.Close()
+	next()
+	for _, id := range []string{"2", "3"} {
+		if got := next(); !strings.HasPrefix(got, "id: "+id+"\n") {
+			t.Errorf("want missed event %s; got %q", id, got)
+		}
+	}
+
+	// Shutting down ends the stream, and no new ones are opened.
+	app.broadcaster.close()
+	for {
+		if _, err := resp.Body.Read(make([]byte, 64)); err != nil {
+			break
+		}
+	}
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("want %d after close; got %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+}
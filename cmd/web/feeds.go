@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+
+	"cb.net/snippetbox/pkg/forms"
+	"cb.net/snippetbox/pkg/models"
+)
+
+// feedSize is the number of quotes included in each feed.
+const feedSize = 20
+
+// feed holds what's needed to render a listing as an Atom or RSS feed. Path
+// is the path of the HTML page the feed mirrors.
+type feed struct {
+	Title    string
+	Path     string
+	Snippets []*models.Snippet
+}
+
+// updated returns the time the most recently changed quote in the feed was
+// last edited, or the zero time if the feed is empty.
+func (f *feed) updated() time.Time {
+	var t time.Time
+	for _, s := range f.Snippets {
+		if s.Updated.After(t) {
+			t = s.Updated
+		}
+	}
+	return t
+}
+
+func (app *application) latestFeed(w http.ResponseWriter, r *http.Request) {
+	page, err := app.snippets.Latest(models.Page{Limit: feedSize})
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.serveFeed(w, r, &feed{Title: "Latest quotes", Path: "/", Snippets: page.Snippets})
+}
+
+func (app *application) tagFeed(w http.ResponseWriter, r *http.Request) {
+	tag := r.URL.Query().Get(":name")
+	if !forms.TagRX.MatchString(tag) {
+		app.notFound(w)
+		return
+	}
+
+	page, err := app.snippets.Tagged(tag, models.Page{Limit: feedSize})
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.serveFeed(w, r, &feed{
+		Title:    fmt.Sprintf("Quotes tagged “%s”", tag),
+		Path:     "/tag/" + url.PathEscape(tag),
+		Snippets: page.Snippets,
+	})
+}
+
+func (app *application) authorFeed(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get(":id"))
+	if err != nil || id < 1 {
+		app.notFound(w)
+		return
+	}
+
+	author, err := app.authors.Get(id)
+	if err == models.ErrNoRecord {
+		app.notFound(w)
+		return
+	} else if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	page, err := app.snippets.ByAuthor(id, models.Page{Limit: feedSize})
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.serveFeed(w, r, &feed{
+		Title:    "Quotes by " + author.Name,
+		Path:     fmt.Sprintf("/author/%d", id),
+		Snippets: page.Snippets,
+	})
+}
+
+// serveFeed renders f in the format named by the extension of the request
+// path, either ".atom" or ".rss". The response carries an ETag computed from
+// the body and a Last-Modified time taken from the newest edit in the feed,
+// and http.ServeContent answers conditional requests from these with 304 Not
+// Modified. The ETag also catches quotes dropping out of the feed, which
+// doesn't change its Last-Modified time.
+func (app *application) serveFeed(w http.ResponseWriter, r *http.Request, f *feed) {
+	var v interface{}
+	var contentType string
+	switch path.Ext(r.URL.Path) {
+	case ".atom":
+		v, contentType = app.atomFeed(r, f), "application/atom+xml; charset=utf-8"
+	case ".rss":
+		v, contentType = app.rssFeed(r, f), "application/rss+xml; charset=utf-8"
+	default:
+		app.notFound(w)
+		return
+	}
+
+	body, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	body = append([]byte(xml.Header), body...)
+
+	sum := sha256.Sum256(body)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	http.ServeContent(w, r, "", f.updated(), bytes.NewReader(body))
+}
+
+// baseURL returns the scheme and host used to build the absolute links
+// which feeds require. It is the -base-url setting if there is one, and is
+// otherwise taken from the request.
+func (app *application) baseURL(r *http.Request) *url.URL {
+	if app.siteURL != nil {
+		return app.siteURL
+	}
+	return &url.URL{Scheme: "https", Host: r.Host}
+}
+
+// entryID returns the permanent ID of a quote in a feed: a tag URI, which
+// unlike the quote's URL doesn't change if the quote is edited.
+func entryID(base *url.URL, s *models.Snippet) string {
+	return fmt.Sprintf("tag:%s,%s:/snippet/%d", base.Hostname(), s.Created.UTC().Format("2006-01-02"), s.ID)
+}
+
+// entryText is the text of a quote as it appears in a feed, followed by its
+// attribution.
+func entryText(s *models.Snippet) string {
+	if s.Author == nil {
+		return s.Content
+	}
+	return fmt.Sprintf("%s\n\n— %s", s.Content, s.Author.Name)
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Links   []atomLink  `xml:"link"`
+	Updated string      `xml:"updated"`
+	Author  atomPerson  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	Title     string      `xml:"title"`
+	ID        string      `xml:"id"`
+	Link      atomLink    `xml:"link"`
+	Published string      `xml:"published"`
+	Updated   string      `xml:"updated"`
+	Author    *atomPerson `xml:"author"`
+	Content   atomText    `xml:"content"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+func (app *application) atomFeed(r *http.Request, f *feed) *atomFeed {
+	base := app.baseURL(r)
+	self := base.ResolveReference(&url.URL{Path: r.URL.Path}).String()
+
+	// Atom requires an updated time, so an empty feed reports the Unix
+	// epoch rather than a time which changes on every request.
+	updated := f.updated()
+	if updated.IsZero() {
+		updated = time.Unix(0, 0)
+	}
+
+	out := &atomFeed{
+		Title: f.Title + " - Quotebox",
+		ID:    self,
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: self},
+			{Rel: "alternate", Type: "text/html", Href: base.ResolveReference(&url.URL{Path: f.Path}).String()},
+		},
+		Updated: updated.UTC().Format(time.RFC3339),
+		Author:  atomPerson{Name: "Quotebox"},
+	}
+	for _, s := range f.Snippets {
+		e := atomEntry{
+			Title:     s.Title,
+			ID:        entryID(base, s),
+			Link:      atomLink{Href: base.ResolveReference(&url.URL{Path: fmt.Sprintf("/snippet/%d", s.ID)}).String()},
+			Published: s.Created.UTC().Format(time.RFC3339),
+			Updated:   s.Updated.UTC().Format(time.RFC3339),
+			Content:   atomText{Type: "text", Body: entryText(s)},
+		}
+		if s.UserName != "" {
+			e.Author = &atomPerson{Name: s.UserName}
+		}
+		out.Entries = append(out.Entries, e)
+	}
+	return out
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+	Description string  `xml:"description"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+func (app *application) rssFeed(r *http.Request, f *feed) *rssFeed {
+	base := app.baseURL(r)
+
+	out := &rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:       f.Title + " - Quotebox",
+			Link:        base.ResolveReference(&url.URL{Path: f.Path}).String(),
+			Description: f.Title + " posted to Quotebox",
+		},
+	}
+	if updated := f.updated(); !updated.IsZero() {
+		out.Channel.LastBuildDate = updated.UTC().Format(time.RFC1123Z)
+	}
+	for _, s := range f.Snippets {
+		out.Channel.Items = append(out.Channel.Items, rssItem{
+			Title:       s.Title,
+			Link:        base.ResolveReference(&url.URL{Path: fmt.Sprintf("/snippet/%d", s.ID)}).String(),
+			GUID:        rssGUID{Value: entryID(base, s)},
+			PubDate:     s.Created.UTC().Format(time.RFC1123Z),
+			Description: entryText(s),
+		})
+	}
+	return out
+}
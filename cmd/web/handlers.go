@@ -1,18 +1,28 @@
 package main
 
 import (
+   "bytes"
    "fmt"
    "net/http"
+   "net/url"
    "strconv"
+   "strings"
+   "time"
 
+   "cb.net/snippetbox/pkg/diff"
    "cb.net/snippetbox/pkg/forms"
    "cb.net/snippetbox/pkg/models"
-   "cb.net/snippetbox/pkg/emails"
+   "cb.net/snippetbox/pkg/quotefile"
 )
 
 func (app *application) home(w http.ResponseWriter, r *http.Request) {
+   p, err := app.page(r)
+   if err != nil {
+      app.clientError(w, http.StatusBadRequest)
+      return
+   }
    
-   s, err := app.snippets.Latest()
+   page, err := app.snippets.Latest(p)
    if err != nil {
       app.serverError(w, err)
       return
@@ -20,15 +30,18 @@ func (app *application) home(w http.ResponseWriter, r *http.Request) {
 
    // Use the new render helper.
    app.render(w, r, "home.page.tmpl", &templateData{
-      Snippets: s,
+      Page: page,
    })
 }
 
-func (app *application) showSnippet(w http.ResponseWriter, r *http.Request) {
+// viewableSnippet fetches the snippet named in the URL. If there isn't one,
+// or the current user isn't allowed to see it, it sends the appropriate error
+// response and returns false.
+func (app *application) viewableSnippet(w http.ResponseWriter, r *http.Request) (*models.Snippet, bool) {
    id, err := strconv.Atoi(r.URL.Query().Get(":id"))
    if err != nil || id < 1 {
       app.notFound(w)
-      return
+      return nil, false
    }
 
    // Use the SnippetModel object's Get method to retrieve the data for a
@@ -37,9 +50,24 @@ func (app *application) showSnippet(w http.ResponseWriter, r *http.Request) {
    s, err := app.snippets.Get(id)
    if err == models.ErrNoRecord {
       app.notFound(w)
-      return
+      return nil, false
    } else if err != nil {
       app.serverError(w, err)
+      return nil, false
+   }
+
+   // Snippets the user isn't allowed to see get the same 404 as missing
+   // ones, so as not to reveal that they exist.
+   if !app.canView(r, s, false) {
+      app.notFound(w)
+      return nil, false
+   }
+   return s, true
+}
+
+func (app *application) showSnippet(w http.ResponseWriter, r *http.Request) {
+   s, ok := app.viewableSnippet(w, r)
+   if !ok {
       return
    }
 
@@ -55,11 +83,33 @@ func (app *application) showSnippet(w http.ResponseWriter, r *http.Request) {
    // Pass the flash message to the template.
    app.render(w, r, "show.page.tmpl", &templateData{
       //Flash: flash,
+      CanModify: app.canModify(r, s),
       Snippet: s,
    })
 
 }
 
+func (app *application) showSharedSnippet(w http.ResponseWriter, r *http.Request) {
+   s, err := app.snippets.GetBySlug(r.URL.Query().Get(":slug"))
+   if err == models.ErrNoRecord {
+      app.notFound(w)
+      return
+   } else if err != nil {
+      app.serverError(w, err)
+      return
+   }
+
+   if !app.canView(r, s, true) {
+      app.notFound(w)
+      return
+   }
+
+   app.render(w, r, "show.page.tmpl", &templateData{
+      CanModify: app.canModify(r, s),
+      Snippet: s,
+   })
+}
+
 // Add a new createSnippetForm handler, which for now returns a placeholder response.
 func (app *application) createSnippetForm(w http.ResponseWriter, r *http.Request) {
    app.render(w, r, "create.page.tmpl", &templateData{
@@ -73,7 +123,7 @@ func (app *application) createSnippet(w http.ResponseWriter, r *http.Request) {
    // requests. If there are any errors, we use our app.ClientError helper to send
    // a 400 Bad Request response to the user.
    // Limit the request body size to 4096 bytes
-   r.Body = http.MaxBytesReader(w, r.Body, 1024)
+   r.Body = http.MaxBytesReader(w, r.Body, 4096)
    err := r.ParseForm()
    if err != nil {
       app.clientError(w, http.StatusBadRequest)
@@ -81,21 +131,30 @@ func (app *application) createSnippet(w http.ResponseWriter, r *http.Request) {
    }
    
    form := forms.New(r.PostForm)
-   form.Required("title", "content", "expires")
-   form.MaxLength("title", 20)
-   form.MaxLength("content", 500)
-   form.PermittedValues("expires", "365", "7", "1")
+   forms.ValidateNewSnippet(form)
 
    if !form.Valid() {
       app.render(w, r, "create.page.tmpl", &templateData{Form: form})
       return
    }
+
+   snippet := forms.Snippet(form)
+   err = app.resolveAuthor(snippet)
+   if err != nil {
+      app.serverError(w, err)
+      return
+   }
    
-   id, err := app.snippets.Insert(form.Get("title"), form.Get("content"), form.Get("expires"))
+   // The requireAuthentication middleware guarantees there is a logged in
+   // user, so record them as the owner of the new snippet.
+   snippet.Expires = forms.ExpiryTime(form)
+   snippet.UserID = app.session.GetInt(r, "authenticatedUserID")
+   id, err := app.snippets.Insert(snippet)
    if err != nil {
       app.serverError(w, err)
       return
    }
+   app.snippetEventByID(r, models.EventSnippetCreated, id)
 
    // Use the Put() method to add a string value ("Your snippet was saved
    // successfully!") and the corresponding key ("flash") to the session
@@ -107,172 +166,1065 @@ func (app *application) createSnippet(w http.ResponseWriter, r *http.Request) {
    http.Redirect(w, r, fmt.Sprintf("/snippet/%d", id), http.StatusSeeOther)
 }
 
-func (app *application) signupUserForm(w http.ResponseWriter, r *http.Request) {
-   app.render(w, r, "signup.page.tmpl", &templateData{
-      Form: forms.New(nil),
-   })      
+// resolveAuthor sets the ID of a snippet's author, looking them up by name
+// and creating them with the optional lifespan and bio from the form if this
+// is the first time they've been quoted.
+func (app *application) resolveAuthor(s *models.Snippet) error {
+   a := s.Author
+   id, err := app.authors.FindOrInsert(a.Name, a.Born, a.Died, a.Bio)
+   if err != nil {
+      return err
+   }
+   a.ID = id
+   return nil
 }
 
-func (app *application) signupUser(w http.ResponseWriter, r *http.Request) {
-   // Parse the form data.
+// modifiableSnippet fetches the snippet named in the URL and checks that the
+// current user may change it. If not, it sends the appropriate error
+// response and returns false.
+func (app *application) modifiableSnippet(w http.ResponseWriter, r *http.Request) (*models.Snippet, bool) {
+   s, ok := app.viewableSnippet(w, r)
+   if !ok {
+      return nil, false
+   }
+
+   if !app.canModify(r, s) {
+      app.forbidden(w)
+      return nil, false
+   }
+   return s, true
+}
+
+func (app *application) editSnippetForm(w http.ResponseWriter, r *http.Request) {
+   s, ok := app.modifiableSnippet(w, r)
+   if !ok {
+      return
+   }
+
+   // Pre-fill the form with the snippet's current values.
+   data := url.Values{}
+   data.Set("title", s.Title)
+   data.Set("content", s.Content)
+   if s.Author != nil {
+      data.Set("author", s.Author.Name)
+   }
+   data.Set("source", s.Source)
+   if s.Year != 0 {
+      data.Set("year", strconv.Itoa(s.Year))
+   }
+   data.Set("tags", strings.Join(s.Tags, ", "))
+   data.Set("visibility", s.Visibility)
+
+   app.render(w, r, "edit.page.tmpl", &templateData{
+      Form: forms.New(data),
+      Snippet: s,
+   })
+}
+
+func (app *application) editSnippet(w http.ResponseWriter, r *http.Request) {
+   s, ok := app.modifiableSnippet(w, r)
+   if !ok {
+      return
+   }
+
+   r.Body = http.MaxBytesReader(w, r.Body, 4096)
    err := r.ParseForm()
    if err != nil {
       app.clientError(w, http.StatusBadRequest)
       return
    }
-   
-   // Validate the form contents using the form helper we made earlier.
+
    form := forms.New(r.PostForm)
-   form.Required("name", "email", "password")
-   form.MatchesPattern("email", forms.EmailRX)
-   form.MinLength("password", 10)
-   
-   // If there are any errors, redisplay the signup form.
+   forms.ValidateSnippet(form)
+
    if !form.Valid() {
-      app.render(w, r, "signup.page.tmpl", &templateData{Form: form})
+      app.render(w, r, "edit.page.tmpl", &templateData{Form: form, Snippet: s})
       return
    }
-   
-   // Try to create a new user record in the database. If the email already exists
-   // add an error message to the form and re-display it.
-   err = app.users.Insert(form.Get("name"), form.Get("email"), form.Get("password"))
-   if err == models.ErrDuplicateEmail {
-      form.Errors.Add("email", "Address is already in use")
-      app.render(w, r, "signup.page.tmpl", &templateData{Form: form})
+
+   updated := forms.Snippet(form)
+   err = app.resolveAuthor(updated)
+   if err != nil {
+      app.serverError(w, err)
+      return
+   }
+   updated.ID = s.ID
+   userID := app.session.GetInt(r, "authenticatedUserID")
+   err = app.snippets.Update(updated, userID)
+   if err == models.ErrNoRecord {
+      app.notFound(w)
       return
    } else if err != nil {
       app.serverError(w, err)
       return
    }
-   // Otherwise add a confirmation flash message to the session confirming that
-   // their signup worked and asking them to log in.
-   app.session.Put(r, "flash", "Your signup was successful. Please log in.")
-   // And redirect the user to the login page.
-   http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+   app.snippetEventByID(r, models.EventSnippetUpdated, s.ID)
+
+   app.session.Put(r, "flash", "Snippet successfully updated!")
+   http.Redirect(w, r, fmt.Sprintf("/snippet/%d", s.ID), http.StatusSeeOther)
 }
 
-func (app *application) loginUserForm(w http.ResponseWriter, r *http.Request) {
-   app.render(w, r, "login.page.tmpl", &templateData{
-      Form: forms.New(nil),
-   })
+func (app *application) deleteSnippet(w http.ResponseWriter, r *http.Request) {
+   s, ok := app.modifiableSnippet(w, r)
+   if !ok {
+      return
+   }
+
+   err := app.snippets.Delete(s.ID)
+   if err != nil && err != models.ErrNoRecord {
+      app.serverError(w, err)
+      return
+   }
+   app.snippetEvent(r, models.EventSnippetDeleted, s)
+
+   app.session.Put(r, "flash", "Snippet moved to the trash.")
+   http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
-func (app *application) loginUser(w http.ResponseWriter, r *http.Request) {
-   //important step...need to make sure to parse that form!
-   err := r.ParseForm()
+func (app *application) userTrash(w http.ResponseWriter, r *http.Request) {
+   userID := app.session.GetInt(r, "authenticatedUserID")
+   s, err := app.snippets.Trash(userID)
    if err != nil {
-      app.clientError(w, http.StatusBadRequest)
+      app.serverError(w, err)
       return
    }
-   // Check whether the credentials are valid. If they're not, add a generic error
-   // message to the form failures map and re-display the login page.
-   form := forms.New(r.PostForm)
-   id, err := app.users.Authenticate(form.Get("email"), form.Get("password"))
-   if err == models.ErrInvalidCredentials {
-      form.Errors.Add("generic", "Email or Password is incorrect")
-      app.render(w, r, "login.page.tmpl", &templateData{Form: form})
+
+   app.render(w, r, "trash.page.tmpl", &templateData{
+      Snippets: s,
+      TrashRetention: app.trashRetention,
+   })
+}
+
+func (app *application) restoreSnippet(w http.ResponseWriter, r *http.Request) {
+   id, err := strconv.Atoi(r.URL.Query().Get(":id"))
+   if err != nil || id < 1 {
+      app.notFound(w)
+      return
+   }
+
+   // The model only restores snippets from the caller's own trash, so
+   // there's no separate authorization check here.
+   userID := app.session.GetInt(r, "authenticatedUserID")
+   err = app.snippets.Restore(id, userID)
+   if err == models.ErrNoRecord {
+      app.notFound(w)
       return
    } else if err != nil {
       app.serverError(w, err)
       return
    }
-   
-   // Add the ID of the current user to the session, so that they are now 'logged
-   // in'.
-   app.session.Put(r, "authenticatedUserID", id)
-   
-   path := app.session.PopString(r, "redirectPathAfterLogin")
-   if path != "" {
-      http.Redirect(w, r, path, http.StatusSeeOther)
+
+   app.session.Put(r, "flash", "Snippet restored from the trash!")
+   http.Redirect(w, r, fmt.Sprintf("/snippet/%d", id), http.StatusSeeOther)
+}
+
+func (app *application) purgeSnippet(w http.ResponseWriter, r *http.Request) {
+   id, err := strconv.Atoi(r.URL.Query().Get(":id"))
+   if err != nil || id < 1 {
+      app.notFound(w)
       return
    }
-   // Redirect the user to the create snippet page.
-   http.Redirect(w, r, "/snippet/create", http.StatusSeeOther)
-}
 
-func (app *application) logoutUser(w http.ResponseWriter, r *http.Request) {
-   // Remove the authenticatedUserID from the session data so that the user is
-   // 'logged out'.
-   app.session.Remove(r, "authenticatedUserID")
-   
-   // Add a flash message to the session to confirm to the user that they've been
-   // logged out.
-   app.session.Put(r, "flash", "You've been logged out successfully!")
-   http.Redirect(w, r, "/", 303)
+   userID := app.session.GetInt(r, "authenticatedUserID")
+   err = app.snippets.Purge(id, userID)
+   if err == models.ErrNoRecord {
+      app.notFound(w)
+      return
+   } else if err != nil {
+      app.serverError(w, err)
+      return
+   }
+
+   app.session.Put(r, "flash", "Snippet permanently deleted.")
+   http.Redirect(w, r, "/user/trash", http.StatusSeeOther)
 }
 
-func (app *application) userProfile(w http.ResponseWriter, r *http.Request) {
-   userID := app.session.GetInt(r, "authenticatedUserID")
-   user, err := app.users.Get(userID)
+func (app *application) snippetHistory(w http.ResponseWriter, r *http.Request) {
+   s, ok := app.viewableSnippet(w, r)
+   if !ok {
+      return
+   }
+
+   revisions, err := app.snippets.Revisions(s.ID)
    if err != nil {
       app.serverError(w, err)
       return
    }
-   app.render(w, r, "profile.page.tmpl", &templateData{
-      User: user,
+
+   app.render(w, r, "history.page.tmpl", &templateData{
+      CanModify: app.canModify(r, s),
+      Revisions: revisions,
+      Snippet: s,
    })
 }
 
-func (app *application) changePasswordForm(w http.ResponseWriter, r *http.Request) {
-   app.render(w, r, "password.page.tmpl", &templateData{
-      Form: forms.New(nil),
+func (app *application) snippetDiff(w http.ResponseWriter, r *http.Request) {
+   s, ok := app.viewableSnippet(w, r)
+   if !ok {
+      return
+   }
+
+   // Look up the two revisions being compared. Both must belong to this
+   // snippet, which the model enforces.
+   var revs [2]*models.Revision
+   for i, param := range []string{"from", "to"} {
+      id, err := strconv.Atoi(r.URL.Query().Get(param))
+      if err != nil || id < 1 {
+         app.clientError(w, http.StatusBadRequest)
+         return
+      }
+      revs[i], err = app.snippets.Revision(s.ID, id)
+      if err == models.ErrNoRecord {
+         app.notFound(w)
+         return
+      } else if err != nil {
+         app.serverError(w, err)
+         return
+      }
+   }
+
+   d := &revisionDiff{From: revs[0], To: revs[1], Mode: "words"}
+   if r.URL.Query().Get("mode") == "lines" {
+      d.Mode = "lines"
+      d.Title = diff.Lines(d.From.Title, d.To.Title)
+      d.Content = diff.Lines(d.From.Content, d.To.Content)
+   } else {
+      d.Title = diff.Words(d.From.Title, d.To.Title)
+      d.Content = diff.Words(d.From.Content, d.To.Content)
+   }
+
+   app.render(w, r, "diff.page.tmpl", &templateData{
+      Diff: d,
+      Snippet: s,
    })
 }
-   
-func (app *application) changePassword(w http.ResponseWriter, r *http.Request) {
-   err := r.ParseForm()
-   if err != nil {
-      app.clientError(w, http.StatusBadRequest)
+
+func (app *application) restoreRevision(w http.ResponseWriter, r *http.Request) {
+   s, ok := app.modifiableSnippet(w, r)
+   if !ok {
       return
    }
-   form := forms.New(r.PostForm)
-   form.Required("currentPassword", "newPassword", "newPasswordConfirmation")
-   form.MinLength("newPassword", 10)
-   
-   if form.Get("newPassword") != form.Get("newPasswordConfirmation") {
-      form.Errors.Add("newPasswordConfirmation", "Passwords do not match")
+
+   revID, err := strconv.Atoi(r.URL.Query().Get(":rev"))
+   if err != nil || revID < 1 {
+      app.notFound(w)
+      return
    }
-   
-   if !form.Valid() {
-      app.render(w, r, "password.page.tmpl", &templateData{Form: form})
+   rev, err := app.snippets.Revision(s.ID, revID)
+   if err == models.ErrNoRecord {
+      app.notFound(w)
+      return
+   } else if err != nil {
+      app.serverError(w, err)
       return
    }
 
+   // Restoring brings back the old wording only; the attribution, tags and
+   // visibility are kept as they are now. The restore is itself saved as a
+   // new revision.
+   s.Title = rev.Title
+   s.Content = rev.Content
    userID := app.session.GetInt(r, "authenticatedUserID")
-   err = app.users.ChangePassword(userID, form.Get("currentPassword"), form.Get("newPassword"))
-   
-   if err == models.ErrInvalidCredentials {
-      form.Errors.Add("currentPassword", "Current password is incorrect")
-      app.render(w, r, "password.page.tmpl", &templateData{Form: form})
+   err = app.snippets.Update(s, userID)
+   if err != nil {
+      app.serverError(w, err)
+      return
+   }
+   app.snippetEventByID(r, models.EventSnippetUpdated, s.ID)
+
+   app.session.Put(r, "flash", fmt.Sprintf("Revision #%d restored!", rev.ID))
+   http.Redirect(w, r, fmt.Sprintf("/snippet/%d", s.ID), http.StatusSeeOther)
+}
+
+func (app *application) showAuthor(w http.ResponseWriter, r *http.Request) {
+   id, err := strconv.Atoi(r.URL.Query().Get(":id"))
+   if err != nil || id < 1 {
+      app.notFound(w)
+      return
+   }
+
+   author, err := app.authors.Get(id)
+   if err == models.ErrNoRecord {
+      app.notFound(w)
       return
    } else if err != nil {
       app.serverError(w, err)
       return
    }
-   
-   app.session.Put(r, "flash", "Your password has been updated!")
-   http.Redirect(w, r, "/user/profile", 303)
-}
 
-func (app *application) passwordResetForm(w http.ResponseWriter, r *http.Request) {
-   app.render(w, r, "passwordreset.page.tmpl", &templateData{
-      Form: forms.New(nil),
+   p, err := app.page(r)
+   if err != nil {
+      app.clientError(w, http.StatusBadRequest)
+      return
+   }
+
+   page, err := app.snippets.ByAuthor(id, p)
+   if err != nil {
+      app.serverError(w, err)
+      return
+   }
+
+   app.render(w, r, "author.page.tmpl", &templateData{
+      Author: author,
+      Page: page,
    })
 }
 
-func (app *application) passwordReset(w http.ResponseWriter, r *http.Request) {
-   err := r.ParseForm()
+func (app *application) showTag(w http.ResponseWriter, r *http.Request) {
+   tag := r.URL.Query().Get(":name")
+   if !forms.TagRX.MatchString(tag) {
+      app.notFound(w)
+      return
+   }
+
+   p, err := app.page(r)
    if err != nil {
       app.clientError(w, http.StatusBadRequest)
       return
    }
-   form := forms.New(r.PostForm)
-   email := emails.New(form.Get("email"), "admin@emergingtek.net", "hello there", "https://192.168.0.171:4000/user/passwordreset?id=12345")
-   email.Send()
-   app.session.Put(r, "flash", "An email has been sent to your correspondence!")
-   http.Redirect(w, r, "/user/passwordreset", 303)
-}
 
-func (app *application) password(w http.ResponseWriter, r *http.Request) {
-   http.Redirect(w, r, "/user/login", 303)
-}
\ No newline at end of file
+   page, err := app.snippets.Tagged(tag, p)
+   if err != nil {
+      app.serverError(w, err)
+      return
+   }
+
+   app.render(w, r, "tag.page.tmpl", &templateData{
+      Page: page,
+      Tag: tag,
+   })
+}
+
+// searchPageSize is the number of results shown on each page of a search.
+const searchPageSize = 10
+
+func (app *application) search(w http.ResponseWriter, r *http.Request) {
+   query := strings.TrimSpace(r.URL.Query().Get("q"))
+   if query == "" {
+      app.render(w, r, "search.page.tmpl", &templateData{})
+      return
+   }
+
+   page, err := strconv.Atoi(r.URL.Query().Get("page"))
+   if err != nil || page < 1 {
+      page = 1
+   }
+
+   // Ask for one more result than we display so we know whether there is a
+   // next page without a separate COUNT query.
+   s, err := app.snippets.Search(query, searchPageSize+1, (page-1)*searchPageSize)
+   if err != nil {
+      app.serverError(w, err)
+      return
+   }
+
+   td := &templateData{Query: query}
+   if len(s) > searchPageSize {
+      s = s[:searchPageSize]
+      td.NextPage = page + 1
+   }
+   if page > 1 {
+      td.PrevPage = page - 1
+   }
+   td.Snippets = s
+
+   app.render(w, r, "search.page.tmpl", td)
+}
+
+func (app *application) signupUserForm(w http.ResponseWriter, r *http.Request) {
+   app.render(w, r, "signup.page.tmpl", &templateData{
+      Form: forms.New(nil),
+   })      
+}
+
+func (app *application) signupUser(w http.ResponseWriter, r *http.Request) {
+   // Parse the form data.
+   err := r.ParseForm()
+   if err != nil {
+      app.clientError(w, http.StatusBadRequest)
+      return
+   }
+   
+   // Validate the form contents using the form helper we made earlier.
+   form := forms.New(r.PostForm)
+   form.Required("name", "email", "password")
+   form.MatchesPattern("email", forms.EmailRX)
+   form.MinLength("password", 10)
+   
+   // If there are any errors, redisplay the signup form.
+   if !form.Valid() {
+      app.render(w, r, "signup.page.tmpl", &templateData{Form: form})
+      return
+   }
+   
+   // Try to create a new user record in the database. If the email already exists
+   // add an error message to the form and re-display it.
+   id, err := app.users.Insert(form.Get("name"), form.Get("email"), form.Get("password"))
+   if err == models.ErrDuplicateEmail {
+      form.Errors.Add("email", "Address is already in use")
+      app.render(w, r, "signup.page.tmpl", &templateData{Form: form})
+      return
+   } else if err != nil {
+      app.serverError(w, err)
+      return
+   }
+
+   // Only admins' webhooks hear about new users.
+   app.dispatcher.notify(&webhookPayload{
+      Event: models.EventUserCreated,
+      User: &webhookUser{ID: id, Name: form.Get("name")},
+   }, 0, false, true)
+
+   // New accounts can't log in until the user follows the link in this
+   // email.
+   err = app.sendVerification(&models.User{ID: id, Name: form.Get("name"), Email: form.Get("email")})
+   if err != nil {
+      app.serverError(w, err)
+      return
+   }
+
+   // Otherwise add a confirmation flash message to the session confirming that
+   // their signup worked and asking them to verify their address.
+   app.session.Put(r, "flash", "Your signup was successful. We've emailed you a link to verify your address, which you'll need to follow before you can log in.")
+   // And redirect the user to the login page.
+   http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+func (app *application) loginUserForm(w http.ResponseWriter, r *http.Request) {
+   app.render(w, r, "login.page.tmpl", &templateData{
+      Form: forms.New(nil),
+   })
+}
+
+func (app *application) loginUser(w http.ResponseWriter, r *http.Request) {
+   //important step...need to make sure to parse that form!
+   err := r.ParseForm()
+   if err != nil {
+      app.clientError(w, http.StatusBadRequest)
+      return
+   }
+   form := forms.New(r.PostForm)
+
+   // Attempts from an address or on an account with a run of failures
+   // behind it are turned away without checking the password. They get the
+   // same message as a wrong password, so that a lockout doesn't give away
+   // that the account exists; its owner is told about it by email instead.
+   allowed, failures, err := app.loginAllowed(r, form.Get("email"))
+   if err != nil {
+      app.serverError(w, err)
+      return
+   }
+   if !allowed {
+      form.Errors.Add("generic", "Email or Password is incorrect")
+      app.render(w, r, "login.page.tmpl", &templateData{Form: form})
+      return
+   }
+
+   // Check whether the credentials are valid. If they're not, add a generic error
+   // message to the form failures map and re-display the login page.
+   id, err := app.users.Authenticate(form.Get("email"), form.Get("password"))
+   if err == models.ErrInvalidCredentials {
+      if err = app.loginFailed(r, failures); err != nil {
+         app.serverError(w, err)
+         return
+      }
+      form.Errors.Add("generic", "Email or Password is incorrect")
+      app.render(w, r, "login.page.tmpl", &templateData{Form: form})
+      return
+   } else if err == models.ErrUnverifiedEmail {
+      form.Errors.Add("unverified", "Please verify your email address by following the link we sent you before logging in.")
+      app.render(w, r, "login.page.tmpl", &templateData{Form: form})
+      return
+   } else if err != nil {
+      app.serverError(w, err)
+      return
+   }
+   
+   // Users with two-factor authentication turned on have to enter a code
+   // before they are logged in.
+   secret, err := app.twoFactor.Secret(id)
+   if err != nil {
+      app.serverError(w, err)
+      return
+   }
+   if secret != "" {
+      app.beginTwoFactorLogin(w, r, id)
+      return
+   }
+   app.completeLogin(w, r, id)
+}
+
+// completeLogin logs a user in once they have proved who they are, and
+// sends them on to the page they were trying to reach, if any.
+func (app *application) completeLogin(w http.ResponseWriter, r *http.Request, id int) {
+   err := app.loginSucceeded(r, id)
+   if err != nil {
+      app.serverError(w, err)
+      return
+   }
+
+   err = app.startSession(r, id)
+   if err != nil {
+      app.serverError(w, err)
+      return
+   }
+
+   // Add the ID of the current user to the session, so that they are now 'logged
+   // in'.
+   app.session.Put(r, "authenticatedUserID", id)
+   
+   path := app.session.PopString(r, "redirectPathAfterLogin")
+   if path != "" {
+      http.Redirect(w, r, path, http.StatusSeeOther)
+      return
+   }
+   // Redirect the user to the create snippet page.
+   http.Redirect(w, r, "/snippet/create", http.StatusSeeOther)
+}
+
+func (app *application) logoutUser(w http.ResponseWriter, r *http.Request) {
+   // Revoke the server-side record of the session, so that the cookie is no
+   // use even if a copy of it is kept somewhere.
+   if sess := app.currentSession(r); sess != nil {
+      err := app.userSessions.Revoke(sess.ID, sess.UserID)
+      if err != nil && err != models.ErrNoRecord {
+         app.serverError(w, err)
+         return
+      }
+   }
+
+   // Remove the authenticatedUserID from the session data so that the user is
+   // 'logged out'.
+   app.endSession(r)
+   
+   // Add a flash message to the session to confirm to the user that they've been
+   // logged out.
+   app.session.Put(r, "flash", "You've been logged out successfully!")
+   http.Redirect(w, r, "/", 303)
+}
+
+func (app *application) userProfile(w http.ResponseWriter, r *http.Request) {
+   userID := app.session.GetInt(r, "authenticatedUserID")
+   user, err := app.users.Get(userID)
+   if err != nil {
+      app.serverError(w, err)
+      return
+   }
+
+   p, err := app.page(r)
+   if err != nil {
+      app.clientError(w, http.StatusBadRequest)
+      return
+   }
+
+   page, err := app.snippets.ByUser(userID, p)
+   if err != nil {
+      app.serverError(w, err)
+      return
+   }
+
+   sessions, err := app.userSessions.ForUser(userID)
+   if err != nil {
+      app.serverError(w, err)
+      return
+   }
+
+   data := &templateData{
+      Page: page,
+      Sessions: sessions,
+      User: user,
+   }
+   if sess := app.currentSession(r); sess != nil {
+      data.SessionID = sess.ID
+   }
+   app.render(w, r, "profile.page.tmpl", data)
+}
+
+func (app *application) userTokens(w http.ResponseWriter, r *http.Request) {
+   app.renderTokens(w, r, forms.New(nil), "")
+}
+
+// renderTokens shows the API tokens page for the current user. newToken is
+// the value of a token that has just been created, which is only ever shown
+// this once.
+func (app *application) renderTokens(w http.ResponseWriter, r *http.Request, form *forms.Form, newToken string) {
+   tokens, err := app.tokens.ForUser(app.session.GetInt(r, "authenticatedUserID"))
+   if err != nil {
+      app.serverError(w, err)
+      return
+   }
+
+   app.render(w, r, "tokens.page.tmpl", &templateData{
+      Form: form,
+      NewToken: newToken,
+      Tokens: tokens,
+   })
+}
+
+func (app *application) createToken(w http.ResponseWriter, r *http.Request) {
+   err := r.ParseForm()
+   if err != nil {
+      app.clientError(w, http.StatusBadRequest)
+      return
+   }
+
+   form := forms.New(r.PostForm)
+   form.Required("name", "scope")
+   form.MaxLength("name", 100)
+   form.PermittedValues("scope", models.ScopeRead, models.ScopeWrite)
+   if !form.Valid() {
+      app.renderTokens(w, r, form, "")
+      return
+   }
+
+   userID := app.session.GetInt(r, "authenticatedUserID")
+   token, err := app.tokens.Insert(userID, form.Get("name"), form.Get("scope"))
+   if err != nil {
+      app.serverError(w, err)
+      return
+   }
+
+   // Render the page directly rather than redirecting, so that the token
+   // never has to be stored anywhere in order to show it to the user.
+   app.renderTokens(w, r, forms.New(nil), token)
+}
+
+func (app *application) revokeToken(w http.ResponseWriter, r *http.Request) {
+   id, err := strconv.Atoi(r.URL.Query().Get(":id"))
+   if err != nil || id < 1 {
+      app.notFound(w)
+      return
+   }
+
+   userID := app.session.GetInt(r, "authenticatedUserID")
+   err = app.tokens.Revoke(id, userID)
+   if err == models.ErrNoRecord {
+      app.notFound(w)
+      return
+   } else if err != nil {
+      app.serverError(w, err)
+      return
+   }
+
+   app.session.Put(r, "flash", "Token revoked.")
+   http.Redirect(w, r, "/user/tokens", http.StatusSeeOther)
+}
+
+func (app *application) userWebhooks(w http.ResponseWriter, r *http.Request) {
+   app.renderWebhooks(w, r, forms.New(nil))
+}
+
+func (app *application) renderWebhooks(w http.ResponseWriter, r *http.Request, form *forms.Form) {
+   hooks, err := app.webhooks.ForUser(app.session.GetInt(r, "authenticatedUserID"))
+   if err != nil {
+      app.serverError(w, err)
+      return
+   }
+
+   app.render(w, r, "webhooks.page.tmpl", &templateData{
+      Events: models.Events,
+      Form: form,
+      Webhooks: hooks,
+   })
+}
+
+func (app *application) createWebhook(w http.ResponseWriter, r *http.Request) {
+   err := r.ParseForm()
+   if err != nil {
+      app.clientError(w, http.StatusBadRequest)
+      return
+   }
+
+   form := forms.New(r.PostForm)
+   form.Required("url", "secret", "events")
+   form.MaxLength("url", 2048)
+   form.URL("url")
+   if u, err := url.Parse(form.Get("url")); err == nil && blockedHost(u.Hostname()) {
+      form.Errors.Add("url", "This field must not be a local or private address")
+   }
+   form.MinLength("secret", 16)
+   form.MaxLength("secret", 255)
+   form.Subset("events", models.Events...)
+   if !form.Valid() {
+      app.renderWebhooks(w, r, form)
+      return
+   }
+
+   userID := app.session.GetInt(r, "authenticatedUserID")
+   _, err = app.webhooks.Insert(userID, form.Get("url"), form.Get("secret"), form.Values["events"])
+   if err != nil {
+      app.serverError(w, err)
+      return
+   }
+
+   app.session.Put(r, "flash", "Webhook added!")
+   http.Redirect(w, r, "/user/webhooks", http.StatusSeeOther)
+}
+
+// ownWebhook fetches the current user's webhook named in the URL, sending a
+// 404 response and returning false if there isn't one.
+func (app *application) ownWebhook(w http.ResponseWriter, r *http.Request) (*models.Webhook, bool) {
+   id, err := strconv.Atoi(r.URL.Query().Get(":id"))
+   if err != nil || id < 1 {
+      app.notFound(w)
+      return nil, false
+   }
+
+   hook, err := app.webhooks.Get(id, app.session.GetInt(r, "authenticatedUserID"))
+   if err == models.ErrNoRecord {
+      app.notFound(w)
+      return nil, false
+   } else if err != nil {
+      app.serverError(w, err)
+      return nil, false
+   }
+   return hook, true
+}
+
+func (app *application) showWebhook(w http.ResponseWriter, r *http.Request) {
+   hook, ok := app.ownWebhook(w, r)
+   if !ok {
+      return
+   }
+
+   deliveries, err := app.webhooks.Deliveries(hook.ID, hook.UserID, 50)
+   if err != nil {
+      app.serverError(w, err)
+      return
+   }
+
+   app.render(w, r, "webhook.page.tmpl", &templateData{
+      Deliveries: deliveries,
+      Webhook: hook,
+   })
+}
+
+func (app *application) deleteWebhook(w http.ResponseWriter, r *http.Request) {
+   hook, ok := app.ownWebhook(w, r)
+   if !ok {
+      return
+   }
+
+   err := app.webhooks.Delete(hook.ID, hook.UserID)
+   if err != nil && err != models.ErrNoRecord {
+      app.serverError(w, err)
+      return
+   }
+
+   app.session.Put(r, "flash", "Webhook deleted.")
+   http.Redirect(w, r, "/user/webhooks", http.StatusSeeOther)
+}
+
+func (app *application) redeliverWebhook(w http.ResponseWriter, r *http.Request) {
+   hook, ok := app.ownWebhook(w, r)
+   if !ok {
+      return
+   }
+
+   id, err := strconv.Atoi(r.URL.Query().Get(":delivery"))
+   if err != nil || id < 1 {
+      app.notFound(w)
+      return
+   }
+
+   err = app.webhooks.Redeliver(id, hook.ID, hook.UserID)
+   if err == models.ErrNoRecord {
+      app.notFound(w)
+      return
+   } else if err != nil {
+      app.serverError(w, err)
+      return
+   }
+   app.dispatcher.poke()
+
+   app.session.Put(r, "flash", fmt.Sprintf("Delivery #%d queued for redelivery.", id))
+   http.Redirect(w, r, fmt.Sprintf("/user/webhooks/%d", hook.ID), http.StatusSeeOther)
+}
+
+// maxImportSize is the largest file that can be uploaded to the import page.
+const maxImportSize = 1 << 20
+
+func (app *application) importForm(w http.ResponseWriter, r *http.Request) {
+   app.renderImport(w, r, forms.New(nil), nil)
+}
+
+func (app *application) renderImport(w http.ResponseWriter, r *http.Request, form *forms.Form, rowErrors []*quotefile.RowError) {
+   app.render(w, r, "import.page.tmpl", &templateData{
+      Form: form,
+      Formats: quotefile.Formats,
+      RowErrors: rowErrors,
+   })
+}
+
+// importQuotes adds the quotes in an uploaded file. Like the import command,
+// it checks every quote with the create snippet rules and either adds them
+// all in one transaction or adds none and lists the problems line by line.
+func (app *application) importQuotes(w http.ResponseWriter, r *http.Request) {
+   r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+   err := r.ParseMultipartForm(maxImportSize)
+   if err != nil {
+      app.clientError(w, http.StatusBadRequest)
+      return
+   }
+
+   form := forms.New(r.PostForm)
+   form.Required("visibility")
+   form.PermittedValues("format", quotefile.Formats...)
+   form.PermittedValues("visibility", models.VisibilityPublic, models.VisibilityUnlisted, models.VisibilityPrivate)
+
+   file, header, err := r.FormFile("file")
+   if err == http.ErrMissingFile {
+      form.Errors.Add("file", "Choose a file to import")
+   } else if err != nil {
+      app.clientError(w, http.StatusBadRequest)
+      return
+   } else {
+      defer file.Close()
+      // noSurf has usually parsed the form before we get to limit the
+      // request body, so check the size of the file itself too.
+      if header.Size > maxImportSize {
+         form.Errors.Add("file", "This file is too large (maximum is 1MB)")
+      }
+   }
+   if !form.Valid() {
+      app.renderImport(w, r, form, nil)
+      return
+   }
+
+   // An empty format means the format should be guessed from the name of
+   // the uploaded file.
+   format := form.Get("format")
+   if format == "" {
+      format = quotefile.FormatForFile(header.Filename)
+   }
+
+   records, err := quotefile.Read(file, format)
+   if err != nil {
+      form.Errors.Add("file", err.Error())
+      app.renderImport(w, r, form, nil)
+      return
+   }
+   if len(records) == 0 {
+      form.Errors.Add("file", "There are no quotes in this file")
+      app.renderImport(w, r, form, nil)
+      return
+   }
+
+   snippets, rowErrors := quotefile.Snippets(records, url.Values{
+      "visibility": {form.Get("visibility")},
+      "expires": {"never"},
+   })
+   if rowErrors != nil {
+      app.renderImport(w, r, form, rowErrors)
+      return
+   }
+
+   userID := app.session.GetInt(r, "authenticatedUserID")
+   for _, s := range snippets {
+      s.UserID = userID
+   }
+   ids, err := app.snippets.InsertMany(snippets)
+   if err != nil {
+      app.serverError(w, err)
+      return
+   }
+
+   app.session.Put(r, "flash", fmt.Sprintf("Imported %d quotes.", len(ids)))
+   http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+}
+
+// exportQuotes downloads the current user's live quotes as a file in the
+// format named in the query string.
+func (app *application) exportQuotes(w http.ResponseWriter, r *http.Request) {
+   query := forms.New(r.URL.Query())
+   query.Required("format")
+   query.PermittedValues("format", quotefile.Formats...)
+   if !query.Valid() {
+      app.clientError(w, http.StatusBadRequest)
+      return
+   }
+   format := query.Get("format")
+
+   snippets, err := app.snippets.Export(app.session.GetInt(r, "authenticatedUserID"))
+   if err != nil {
+      app.serverError(w, err)
+      return
+   }
+
+   // Write to a buffer first, so that an error can still be reported with
+   // a 500 response rather than a truncated download.
+   buf := new(bytes.Buffer)
+   err = quotefile.Write(buf, format, snippets)
+   if err != nil {
+      app.serverError(w, err)
+      return
+   }
+
+   w.Header().Set("Content-Type", quotefile.ContentType(format))
+   w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="quotes%s"`, quotefile.Extension(format)))
+   buf.WriteTo(w)
+}
+
+func (app *application) changePasswordForm(w http.ResponseWriter, r *http.Request) {
+   app.render(w, r, "password.page.tmpl", &templateData{
+      Form: forms.New(nil),
+   })
+}
+   
+func (app *application) changePassword(w http.ResponseWriter, r *http.Request) {
+   err := r.ParseForm()
+   if err != nil {
+      app.clientError(w, http.StatusBadRequest)
+      return
+   }
+   form := forms.New(r.PostForm)
+   form.Required("currentPassword", "newPassword", "newPasswordConfirmation")
+   form.MinLength("newPassword", 10)
+   
+   if form.Get("newPassword") != form.Get("newPasswordConfirmation") {
+      form.Errors.Add("newPasswordConfirmation", "Passwords do not match")
+   }
+   
+   if !form.Valid() {
+      app.render(w, r, "password.page.tmpl", &templateData{Form: form})
+      return
+   }
+
+   userID := app.session.GetInt(r, "authenticatedUserID")
+   err = app.users.ChangePassword(userID, form.Get("currentPassword"), form.Get("newPassword"))
+   
+   if err == models.ErrInvalidCredentials {
+      form.Errors.Add("currentPassword", "Current password is incorrect")
+      app.render(w, r, "password.page.tmpl", &templateData{Form: form})
+      return
+   } else if err != nil {
+      app.serverError(w, err)
+      return
+   }
+
+   // Anyone else who had got hold of a session should lose it along with
+   // the old password.
+   keep := 0
+   if sess := app.currentSession(r); sess != nil {
+      keep = sess.ID
+   }
+   err = app.userSessions.RevokeOthers(userID, keep)
+   if err != nil {
+      app.serverError(w, err)
+      return
+   }
+   
+   app.session.Put(r, "flash", "Your password has been updated!")
+   http.Redirect(w, r, "/user/profile", 303)
+}
+
+func (app *application) passwordResetForm(w http.ResponseWriter, r *http.Request) {
+   app.render(w, r, "passwordreset.page.tmpl", &templateData{
+      Form: forms.New(nil),
+   })
+}
+
+// passwordReset emails a link for choosing a new password to the address
+// given, if it belongs to an account. The response is the same either way.
+func (app *application) passwordReset(w http.ResponseWriter, r *http.Request) {
+   err := r.ParseForm()
+   if err != nil {
+      app.clientError(w, http.StatusBadRequest)
+      return
+   }
+
+   form := forms.New(r.PostForm)
+   form.Required("email")
+   form.MaxLength("email", 255)
+   form.MatchesPattern("email", forms.EmailRX)
+   if !form.Valid() {
+      app.render(w, r, "passwordreset.page.tmpl", &templateData{Form: form})
+      return
+   }
+
+   token, err := app.resets.Insert(form.Get("email"), app.resetLifetime)
+   if err != nil && err != models.ErrNoRecord {
+      app.serverError(w, err)
+      return
+   }
+
+   if token != "" {
+      body := fmt.Sprintf("Someone asked to reset the password for your Quotebox account. "+
+         "To choose a new password, follow this link before %s UTC:\n\n%s\n\n"+
+         "If it wasn't you, you can ignore this email and your password won't change.\n",
+         humanDate(time.Now().UTC().Add(app.resetLifetime)), app.emailLink("/user/password/"+token, nil))
+      app.sendEmail(form.Get("email"), "Reset your Quotebox password", body)
+   }
+
+   app.session.Put(r, "flash", "If there is an account with that email address, we've sent it a link to reset your password.")
+   http.Redirect(w, r, "/user/passwordreset", http.StatusSeeOther)
+}
+
+// renderNewPassword shows the form for choosing a new password with a reset
+// token, or explains that the link is no good if token is empty. The token
+// is in the page's URL, so browsers are told not to send it on to other
+// sites in the Referer header.
+func (app *application) renderNewPassword(w http.ResponseWriter, r *http.Request, form *forms.Form, token string) {
+   w.Header().Set("Referrer-Policy", "no-referrer")
+   app.render(w, r, "newpassword.page.tmpl", &templateData{
+      Form: form,
+      ResetToken: token,
+   })
+}
+
+func (app *application) newPasswordForm(w http.ResponseWriter, r *http.Request) {
+   token := r.URL.Query().Get(":token")
+   _, err := app.resets.Check(token)
+   if err == models.ErrNoRecord {
+      token = ""
+   } else if err != nil {
+      app.serverError(w, err)
+      return
+   }
+   app.renderNewPassword(w, r, forms.New(nil), token)
+}
+
+func (app *application) newPassword(w http.ResponseWriter, r *http.Request) {
+   err := r.ParseForm()
+   if err != nil {
+      app.clientError(w, http.StatusBadRequest)
+      return
+   }
+   token := r.URL.Query().Get(":token")
+
+   form := forms.New(r.PostForm)
+   form.Required("newPassword", "newPasswordConfirmation")
+   form.MinLength("newPassword", 10)
+   if form.Get("newPassword") != form.Get("newPasswordConfirmation") {
+      form.Errors.Add("newPasswordConfirmation", "Passwords do not match")
+   }
+   if !form.Valid() {
+      app.renderNewPassword(w, r, form, token)
+      return
+   }
+
+   // Using up the token first means it can only ever set one password,
+   // even if the same form is submitted twice at once.
+   userID, err := app.resets.Consume(token)
+   if err == models.ErrNoRecord {
+      app.renderNewPassword(w, r, forms.New(nil), "")
+      return
+   } else if err != nil {
+      app.serverError(w, err)
+      return
+   }
+
+   err = app.users.SetPassword(userID, form.Get("newPassword"))
+   if err != nil {
+      app.serverError(w, err)
+      return
+   }
+   err = app.userSessions.RevokeOthers(userID, 0)
+   if err != nil {
+      app.serverError(w, err)
+      return
+   }
+
+   app.session.Put(r, "flash", "Your password has been reset. Please log in.")
+   http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
@@ -4,9 +4,12 @@ import (
    "bytes"
    "fmt"
    "net/http"
+   "net/url"
    "runtime/debug"
    "time"
    
+   "cb.net/snippetbox/pkg/emails"
+   "cb.net/snippetbox/pkg/models"
 	"github.com/justinas/nosurf"
 )
 
@@ -29,6 +32,9 @@ func (app *application) addDefaultData(td *templateData, r *http.Request) *templ
    // Add the authentication status to the template data.
    td.IsAuthenticated = app.isAuthenticated(r)
 
+   // Add the external providers users can log in with.
+   td.Providers = app.oidcProviders
+
 
    return td
 }
@@ -70,6 +76,76 @@ func (app *application) isAuthenticated(r *http.Request) bool {
    return isAuthenticated
 }
 
+// Return the user placed in the request context by the authenticate
+// middleware, or nil if the request is not from an authenticated user.
+func (app *application) authenticatedUser(r *http.Request) *models.User {
+   user, ok := r.Context().Value(contextKeyUser).(*models.User)
+   if !ok {
+      return nil
+   }
+   return user
+}
+
+// Return true if the current user posted the snippet.
+func (app *application) isOwner(r *http.Request, s *models.Snippet) bool {
+   user := app.authenticatedUser(r)
+   return user != nil && s.UserID != 0 && s.UserID == user.ID
+}
+
+// Return true if the current user may see the snippet. Public snippets are
+// visible to everyone and private ones only to their owner. Unlisted
+// snippets are visible to anyone who reaches them through their share link,
+// which is indicated by viaSlug.
+func (app *application) canView(r *http.Request, s *models.Snippet, viaSlug bool) bool {
+   switch s.Visibility {
+   case models.VisibilityPublic:
+      return true
+   case models.VisibilityUnlisted:
+      return viaSlug || app.isOwner(r, s)
+   }
+   return app.isOwner(r, s)
+}
+
+// Return true if the current user may edit or delete the snippet: that is,
+// if they posted it or are an admin.
+func (app *application) canModify(r *http.Request, s *models.Snippet) bool {
+   user := app.authenticatedUser(r)
+   if user == nil {
+      return false
+   }
+   return user.Admin || app.isOwner(r, s)
+}
+
+// The page helper reads the keyset pagination cursors from the "before" and
+// "after" query string parameters. It returns models.ErrInvalidCursor if
+// either is malformed.
+func (app *application) page(r *http.Request) (models.Page, error) {
+   p := models.Page{Limit: app.pageSize}
+   var err error
+   if before := r.URL.Query().Get("before"); before != "" {
+      p.Before, err = models.ParseCursor(before)
+   } else if after := r.URL.Query().Get("after"); after != "" {
+      p.After, err = models.ParseCursor(after)
+   }
+   return p, err
+}
+
+// emailLink returns the absolute URL of a page on the site for a link in an
+// email. Links in emails are only ever built from the -base-url setting,
+// never the Host header, which anyone can set to a site of their own to have
+// the tokens in such links sent there.
+func (app *application) emailLink(path string, query url.Values) string {
+   u := app.siteURL.ResolveReference(&url.URL{Path: path, RawQuery: query.Encode()})
+   return u.String()
+}
+
+// sendEmail sends an email in the background, so that slow mail servers
+// don't hold up the response, and the time it takes can't be used to tell
+// whether an email was sent at all.
+func (app *application) sendEmail(to, subject, body string) {
+   go emails.New(to, app.mailFrom, subject, body).Send()
+}
+
 // The serverError helper writes an error message and stack trace to the errorLog,
 // then sends a generic 500 Internal Server Error response to the user.
 func (app *application) serverError(w http.ResponseWriter, err error) {
@@ -86,6 +162,11 @@ func (app *application) clientError(w http.ResponseWriter, status int) {
    http.Error(w, http.StatusText(status), status)
 }
 
+// The forbidden helper sends a 403 Forbidden response to the user.
+func (app *application) forbidden(w http.ResponseWriter) {
+   app.clientError(w, http.StatusForbidden)
+}
+
 // For consistency, we'll also implement a notFound helper. This is simply a
 // convenience wrapper around clientError which sends a 404 Not Found response to
 // the user.
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"cb.net/snippetbox/pkg/models"
+)
+
+// The first few failed logins are free; after that each one doubles the
+// time before the next attempt is allowed, up to maxLoginDelay.
+const (
+	freeLoginFailures = 3
+	maxLoginDelay     = time.Minute
+)
+
+// loginDelay returns how long to wait after the last of count failed login
+// attempts before allowing another.
+func loginDelay(count int) time.Duration {
+	if count < freeLoginFailures {
+		return 0
+	}
+	shift := uint(count - freeLoginFailures)
+	if shift > 6 {
+		return maxLoginDelay
+	}
+	d := time.Second << shift
+	if d > maxLoginDelay {
+		d = maxLoginDelay
+	}
+	return d
+}
+
+// loginWait returns how long there is to go before another login attempt is
+// allowed, given a run of count failures, the last of them at last, and any
+// lockout, or zero if one is allowed now.
+func loginWait(now time.Time, count int, last, lockedUntil time.Time) time.Duration {
+	wait := lockedUntil.Sub(now)
+	if d := last.Add(loginDelay(count)).Sub(now); d > wait {
+		wait = d
+	}
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// failureCounter counts failed login attempts from each IP address in
+// memory, in the same way as failed attempts on each account are counted in
+// the database. An address which reaches threshold failures in a row is
+// locked out for the lockout duration. Entries which have been left alone
+// for longer than idle are evicted.
+type failureCounter struct {
+	threshold int
+	lockout   time.Duration
+	idle      time.Duration
+
+	// now returns the current time. It is a field so that the clock can be
+	// replaced when testing.
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*failures
+	swept   time.Time
+}
+
+type failures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+func newFailureCounter(threshold int, lockout, idle time.Duration) *failureCounter {
+	return &failureCounter{
+		threshold: threshold,
+		lockout:   lockout,
+		idle:      idle,
+		now:       time.Now,
+		entries:   make(map[string]*failures),
+	}
+}
+
+// wait returns how long key must wait before its next attempt.
+func (c *failureCounter) wait(key string) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f, ok := c.entries[key]
+	if !ok {
+		return 0
+	}
+	return loginWait(c.now(), f.count, f.last, f.lockedUntil)
+}
+
+// fail counts a failed attempt by key.
+func (c *failureCounter) fail(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if now.Sub(c.swept) > c.idle {
+		c.evict(now)
+	}
+
+	f, ok := c.entries[key]
+	if !ok {
+		f = &failures{}
+		c.entries[key] = f
+	}
+	f.count++
+	f.last = now
+	if f.count >= c.threshold {
+		f.count = 0
+		f.lockedUntil = now.Add(c.lockout)
+	}
+}
+
+// reset forgets key's failures after a successful attempt.
+func (c *failureCounter) reset(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+// evict removes entries which are neither locked out nor recent enough to
+// matter.
+func (c *failureCounter) evict(now time.Time) {
+	for key, f := range c.entries {
+		if now.After(f.lockedUntil) && now.Sub(f.last) > c.idle {
+			delete(c.entries, key)
+		}
+	}
+	c.swept = now
+}
+
+// loginAllowed reports whether a login attempt for the account with the
+// given email address may go ahead, as far as failed attempts from the
+// client's IP address and on the account are concerned. It also returns the
+// account's failure record, which is nil if there is no such account.
+func (app *application) loginAllowed(r *http.Request, email string) (bool, *models.LoginFailures, error) {
+	if app.ipFailures.wait(remoteIP(r)) > 0 {
+		return false, nil, nil
+	}
+
+	f, err := app.users.LoginFailures(email)
+	if err == models.ErrNoRecord {
+		return true, nil, nil
+	} else if err != nil {
+		return false, nil, err
+	}
+	return loginWait(time.Now(), f.Count, f.Last, f.LockedUntil) == 0, f, nil
+}
+
+// loginFailed counts a failed login attempt against the client's IP address
+// and, if there is one, the account. The owner of an account which is
+// locked as a result is sent an email about it.
+func (app *application) loginFailed(r *http.Request, f *models.LoginFailures) error {
+	app.ipFailures.fail(remoteIP(r))
+	if f == nil {
+		return nil
+	}
+
+	locked, err := app.users.RecordLoginFailure(f.UserID, app.lockoutThreshold, app.lockoutDuration)
+	if err != nil || !locked {
+		return err
+	}
+	app.infoLog.Printf("Locked account %d after %d failed logins", f.UserID, app.lockoutThreshold)
+
+	body := fmt.Sprintf("Hello %s,\n\nThere have been %d failed attempts to log in to your Quotebox account, "+
+		"so it has been locked until %s UTC.\n\n"+
+		"If this was you, you can log in again after that. "+
+		"If not, someone may be trying to guess your password, and you should make sure it is a strong one.\n\n"+
+		"You can also reset your password now, which unlocks your account:\n\n%s\n",
+		f.Name, app.lockoutThreshold, humanDate(time.Now().UTC().Add(app.lockoutDuration)),
+		app.emailLink("/user/passwordreset", nil))
+	app.sendEmail(f.Email, "Your Quotebox account has been locked", body)
+	return nil
+}
+
+// loginSucceeded clears the failed attempts against the client's IP address
+// and the account once a user has logged in.
+func (app *application) loginSucceeded(r *http.Request, id int) error {
+	app.ipFailures.reset(remoteIP(r))
+	return app.users.ResetLoginFailures(id)
+}
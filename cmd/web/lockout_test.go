@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginDelay(t *testing.T) {
+	tests := []struct {
+		count int
+		want  time.Duration
+	}{
+		{0, 0},
+		{1, 0},
+		{2, 0},
+		{3, time.Second},
+		{4, 2 * time.Second},
+		{5, 4 * time.Second},
+		{8, 32 * time.Second},
+		{9, time.Minute},
+		{10, time.Minute},
+		{100, time.Minute},
+	}
+
+	for _, tt := range tests {
+		if got := loginDelay(tt.count); got != tt.want {
+			t.Errorf("loginDelay(%d): want %v; got %v", tt.count, tt.want, got)
+		}
+	}
+}
+
+func TestLoginWait(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		count       int
+		last        time.Time
+		lockedUntil time.Time
+		want        time.Duration
+	}{
+		{"No failures", 0, time.Time{}, time.Time{}, 0},
+		{"Free failures", 2, now, time.Time{}, 0},
+		{"Delay running", 4, now.Add(-500 * time.Millisecond), time.Time{}, 1500 * time.Millisecond},
+		{"Delay over", 4, now.Add(-3 * time.Second), time.Time{}, 0},
+		{"Locked out", 0, now.Add(-time.Minute), now.Add(10 * time.Minute), 10 * time.Minute},
+		{"Lockout over", 0, now.Add(-time.Hour), now.Add(-time.Minute), 0},
+		{"Longer of delay and lockout", 9, now, now.Add(30 * time.Second), time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := loginWait(now, tt.count, tt.last, tt.lockedUntil); got != tt.want {
+				t.Errorf("want %v; got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestFailureCounter(t *testing.T) {
+	// Locked out for ten minutes after five failures in a row.
+	c := newFailureCounter(5, 10*time.Minute, time.Hour)
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	c.now = clock.now
+
+	steps := []struct {
+		name     string
+		advance  time.Duration
+		key      string
+		fail     bool
+		wantWait time.Duration
+	}{
+		{"First failure", 0, "a", true, 0},
+		{"Second failure", 0, "a", true, 0},
+		{"Third failure", 0, "a", true, time.Second},
+		{"Delay passes", time.Second, "a", false, 0},
+		{"Fourth failure", 0, "a", true, 2 * time.Second},
+		{"Other keys unaffected", 0, "b", false, 0},
+		{"Half the delay", time.Second, "a", false, time.Second},
+		{"Fifth failure locks out", time.Second, "a", true, 10 * time.Minute},
+		{"Still locked out", 5 * time.Minute, "a", false, 5 * time.Minute},
+		{"Lockout over", 5 * time.Minute, "a", false, 0},
+		{"Count starts again", 0, "a", true, 0},
+	}
+
+	for _, st := range steps {
+		clock.advance(st.advance)
+		if st.fail {
+			c.fail(st.key)
+		}
+		if got := c.wait(st.key); got != st.wantWait {
+			t.Errorf("%s: want wait %v; got %v", st.name, st.wantWait, got)
+		}
+	}
+
+	c.reset("a")
+	if got := c.wait("a"); got != 0 {
+		t.Errorf("after reset: want no wait; got %v", got)
+	}
+}
+
+func TestFailureCounterEvict(t *testing.T) {
+	c := newFailureCounter(2, 3*time.Hour, time.Hour)
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	c.now = clock.now
+
+	c.fail("idle")
+	c.fail("locked")
+	c.fail("locked")
+	clock.advance(2 * time.Hour)
+	c.fail("recent")
+
+	for key, want := range map[string]bool{"idle": false, "locked": true, "recent": true} {
+		if _, ok := c.entries[key]; ok != want {
+			t.Errorf("entry %q kept: want %v; got %v", key, want, ok)
+		}
+	}
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+   "context"
    "crypto/tls"
    "flag"
    "log"
    "net/http"
+   "net/url"
    "os"
+   "os/signal"
+   "syscall"
    "database/sql"
    "html/template"
    "time"
@@ -20,36 +24,172 @@ import (
 type contextKey string
 
 var contextKeyIsAuthenticated = contextKey("isAuthenticated")
+var contextKeyUser = contextKey("user")
+var contextKeyScope = contextKey("scope")
+var contextKeySession = contextKey("session")
 
 type application struct {
+   authors interface {
+      Get(int) (*models.Author, error)
+      FindOrInsert(string, int, int, string) (int, error)
+   }
+   broadcaster *broadcaster
+   dispatcher *dispatcher
    errorLog *log.Logger
+   eventHeartbeat time.Duration
+   identities interface {
+      Get(string, string) (int, error)
+      Insert(int, string, string, string) error
+   }
    infoLog *log.Logger
+   ipFailures *failureCounter
+   jwtKey []byte
+   jwtLifetime time.Duration
+   lockoutDuration time.Duration
+   lockoutThreshold int
+   loginLimiter *limiter
+   mailFrom string
+   oidcProviders []*oidcProvider
+   pageSize int
+   postLimiter *limiter
+   resetLifetime time.Duration
+   resets interface {
+      Insert(string, time.Duration) (string, error)
+      Check(string) (int, error)
+      Consume(string) (int, error)
+   }
    session *sessions.Session
+   siteURL *url.URL
    snippets interface {
-      Insert(string, string, string) (int, error)
+      Insert(*models.Snippet) (int, error)
+      InsertMany([]*models.Snippet) ([]int, error)
+      Export(int) ([]*models.Snippet, error)
       Get(int) (*models.Snippet, error)
-      Latest() ([]*models.Snippet, error)
+      GetBySlug(string) (*models.Snippet, error)
+      Latest(models.Page) (*models.SnippetPage, error)
+      ByAuthor(int, models.Page) (*models.SnippetPage, error)
+      Tagged(string, models.Page) (*models.SnippetPage, error)
+      ByUser(int, models.Page) (*models.SnippetPage, error)
+      Update(*models.Snippet, int) error
+      Delete(int) error
+      Trash(int) ([]*models.Snippet, error)
+      Restore(int, int) error
+      Purge(int, int) error
+      Revisions(int) ([]*models.Revision, error)
+      Revision(int, int) (*models.Revision, error)
+      Search(string, int, int) ([]*models.Snippet, error)
    }
    templateCache map[string]*template.Template
+   tokens interface {
+      Insert(int, string, string) (string, error)
+      ForUser(int) ([]*models.Token, error)
+      Revoke(int, int) error
+      Authenticate(string) (*models.Token, error)
+   }
+   trashRetention time.Duration
+   twoFactor interface {
+      Secret(int) (string, error)
+      Enable(int, string, int64, []string) error
+      Disable(int) error
+      UseStep(int, int64) error
+      UseRecoveryCode(int, string) error
+      RecoveryCodesLeft(int) (int, error)
+      ReplaceRecoveryCodes(int, []string) error
+   }
+   webhooks interface {
+      Insert(int, string, string, []string) (int, error)
+      Get(int, int) (*models.Webhook, error)
+      ForUser(int) ([]*models.Webhook, error)
+      Delete(int, int) error
+      Deliveries(int, int, int) ([]*models.Delivery, error)
+      Redeliver(int, int, int) error
+   }
+   userSessions interface {
+      Insert(int, string, string, time.Duration) (string, error)
+      Get(string) (*models.Session, error)
+      Touch(int, string) error
+      ForUser(int) ([]*models.Session, error)
+      Revoke(int, int) error
+      RevokeOthers(int, int) error
+   }
    users interface {
-      Insert(string, string, string) error
+      Insert(string, string, string) (int, error)
+      InsertExternal(string, string) (int, error)
       Authenticate(string, string) (int, error)
       Get(int) (*models.User, error)
       ChangePassword(int, string, string) error
+      SetPassword(int, string) error
+      VerifyEmail(int, string) error
+      GetByEmail(string) (*models.User, error)
+      CheckPassword(int, string) error
+      LoginFailures(string) (*models.LoginFailures, error)
+      RecordLoginFailure(int, int, time.Duration) (bool, error)
+      ResetLoginFailures(int) error
    }
+   verifyKey []byte
+   verifyLifetime time.Duration
+   verifyLimiter *limiter
 }
 
 //Config struct for flags
 type Config struct {
    Addr string
+   BaseURL string
+   EventHeartbeat time.Duration
+   JWTLifetime time.Duration
+   LockoutDuration time.Duration
+   LockoutIPThreshold int
+   LockoutThreshold int
+   LoginBurst int
+   LoginRate int
+   MailFrom string
+   OIDCProviders string
+   PageSize int
+   PostBurst int
+   PostRate int
+   RateLimitIdle time.Duration
+   ReapArchive bool
+   ReapBatchSize int
+   ReapInterval time.Duration
+   ResetLifetime time.Duration
    StaticDir string
+   TrashRetention time.Duration
+   VerifyLifetime time.Duration
+   WebhookAttempts int
+   WebhookBackoff time.Duration
+   WebhookInterval time.Duration
+   WebhookTimeout time.Duration
 }
 
 func main() {
    //using a struct for storing variables
    cfg := new(Config)
    flag.StringVar(&cfg.Addr, "addr", ":4000", "HTTP network address")
+   flag.StringVar(&cfg.BaseURL, "base-url", "", "Public URL of the site, used for links in emails and feeds (required)")
    flag.StringVar(&cfg.StaticDir, "static-dir", "./ui/static", "Path to static assets")
+   flag.IntVar(&cfg.PageSize, "page-size", 10, "Number of quotes shown on each page of a listing")
+   flag.DurationVar(&cfg.TrashRetention, "trash-retention", 30*24*time.Hour, "How long deleted quotes are kept in the trash")
+   flag.DurationVar(&cfg.ReapInterval, "reap-interval", time.Hour, "How often expired quotes are removed")
+   flag.IntVar(&cfg.ReapBatchSize, "reap-batch", 500, "Maximum number of expired quotes removed per batch")
+   flag.IntVar(&cfg.LoginRate, "login-rate", 5, "Login, signup and password reset attempts allowed per minute from each client (0 to disable)")
+   flag.IntVar(&cfg.LoginBurst, "login-burst", 5, "Login, signup and password reset attempts allowed in a burst")
+   flag.IntVar(&cfg.LockoutThreshold, "lockout-threshold", 10, "Failed logins in a row after which an account is locked")
+   flag.IntVar(&cfg.LockoutIPThreshold, "lockout-ip-threshold", 50, "Failed logins in a row after which an IP address is locked out")
+   flag.DurationVar(&cfg.LockoutDuration, "lockout-duration", 15*time.Minute, "How long accounts and IP addresses stay locked out")
+   flag.IntVar(&cfg.PostRate, "post-rate", 10, "Quotes each client may post per minute (0 to disable)")
+   flag.IntVar(&cfg.PostBurst, "post-burst", 5, "Quotes each client may post in a burst")
+   flag.DurationVar(&cfg.RateLimitIdle, "rate-limit-idle", 10*time.Minute, "How long an idle client's rate limit state is kept")
+   flag.DurationVar(&cfg.WebhookTimeout, "webhook-timeout", 10*time.Second, "Time allowed for each webhook delivery")
+   flag.IntVar(&cfg.WebhookAttempts, "webhook-attempts", 8, "Number of times a webhook delivery is attempted before it is marked as failed")
+   flag.DurationVar(&cfg.WebhookBackoff, "webhook-backoff", 30*time.Second, "Delay before the first webhook retry, doubled after each further failure")
+   flag.DurationVar(&cfg.WebhookInterval, "webhook-interval", time.Minute, "How often webhook retries are checked for")
+   flag.DurationVar(&cfg.EventHeartbeat, "event-heartbeat", 30*time.Second, "How often idle live update streams are sent a heartbeat")
+   flag.DurationVar(&cfg.JWTLifetime, "jwt-lifetime", 15*time.Minute, "How long signed API tokens issued by /api/v1/token remain valid")
+   flag.StringVar(&cfg.OIDCProviders, "oidc-providers", "", "JSON file listing the OpenID Connect providers users can log in with")
+   flag.StringVar(&cfg.MailFrom, "mail-from", "admin@emergingtek.net", "Address emails to users are sent from")
+   flag.DurationVar(&cfg.ResetLifetime, "reset-lifetime", time.Hour, "How long password reset links remain valid")
+   flag.DurationVar(&cfg.VerifyLifetime, "verify-lifetime", 48*time.Hour, "How long email verification links remain valid")
+   flag.BoolVar(&cfg.ReapArchive, "reap-archive", false, "Copy expired quotes to the archive table instead of discarding them")
    
    // Define a new command-line flag with the name 'addr', a default value of ":4000"
    // and some short help text explaining what the flag controls. The value of the
@@ -82,6 +222,38 @@ func main() {
    // file name and line number.
    errorLog := log.New(os.Stderr, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
 
+   if cfg.PageSize < 1 {
+      errorLog.Fatal("page-size must be at least 1")
+   }
+   if cfg.LockoutThreshold < 1 || cfg.LockoutIPThreshold < 1 || cfg.LockoutDuration <= 0 {
+      errorLog.Fatal("lockout-threshold, lockout-ip-threshold and lockout-duration must be positive")
+   }
+   if cfg.ResetLifetime <= 0 || cfg.VerifyLifetime <= 0 {
+      errorLog.Fatal("reset-lifetime and verify-lifetime must be positive")
+   }
+   if cfg.EventHeartbeat <= 0 {
+      errorLog.Fatal("event-heartbeat must be positive")
+   }
+   if cfg.WebhookAttempts < 1 || cfg.WebhookBackoff <= 0 || cfg.WebhookInterval <= 0 || cfg.WebhookTimeout <= 0 {
+      errorLog.Fatal("webhook-attempts, webhook-backoff, webhook-interval and webhook-timeout must be positive")
+   }
+
+   // Every account is verified by email, and the links in emails are only
+   // ever built from base-url, so the site can't run without it.
+   siteURL, err := url.Parse(cfg.BaseURL)
+   if err != nil || siteURL.Scheme == "" || siteURL.Host == "" {
+      errorLog.Fatal("base-url must be set to an absolute URL such as https://quotes.example.com")
+   }
+
+   var providers []*oidcProvider
+   if cfg.OIDCProviders != "" {
+      p, err := loadOIDCProviders(cfg.OIDCProviders, siteURL)
+      if err != nil {
+         errorLog.Fatal(err)
+      }
+      providers = p
+   }
+
    db, err := openDB(*dsn)
    if err != nil {
       errorLog.Fatal(err)
@@ -102,15 +274,63 @@ func main() {
    session.Lifetime = 12 * time.Hour
    session.Secure = true
 
+   // The webhook dispatcher delivers event payloads in the background.
+   dp := &dispatcher{
+      webhooks: &mysql.WebhookModel{DB: db},
+      client: newWebhookClient(cfg.WebhookTimeout),
+      errorLog: errorLog,
+      infoLog: infoLog,
+      interval: cfg.WebhookInterval,
+      backoff: cfg.WebhookBackoff,
+      maxAttempts: cfg.WebhookAttempts,
+      now: time.Now,
+   }
+
    //application dependencies
    app := &application{
+       authors: &mysql.AuthorModel{DB: db},
+       broadcaster: newBroadcaster(),
+       dispatcher: dp,
        errorLog: errorLog,
+       eventHeartbeat: cfg.EventHeartbeat,
+       identities: &mysql.IdentityModel{DB: db},
        infoLog: infoLog,
+       ipFailures: newFailureCounter(cfg.LockoutIPThreshold, cfg.LockoutDuration, cfg.LockoutDuration),
+       jwtKey: jwtKey([]byte(*secret)),
+       lockoutDuration: cfg.LockoutDuration,
+       lockoutThreshold: cfg.LockoutThreshold,
+       jwtLifetime: cfg.JWTLifetime,
+       loginLimiter: newLimiter(cfg.LoginRate, cfg.LoginBurst, cfg.RateLimitIdle),
+       mailFrom: cfg.MailFrom,
+       oidcProviders: providers,
+       pageSize: cfg.PageSize,
+       postLimiter: newLimiter(cfg.PostRate, cfg.PostBurst, cfg.RateLimitIdle),
+       resetLifetime: cfg.ResetLifetime,
+       resets: &mysql.PasswordResetModel{DB: db},
        session: session,
+       siteURL: siteURL,
        snippets: &mysql.SnippetModel{DB: db},
        templateCache: templateCache,
+       tokens: &mysql.TokenModel{DB: db},
+       trashRetention: cfg.TrashRetention,
+       twoFactor: &mysql.TwoFactorModel{DB: db},
+       webhooks: &mysql.WebhookModel{DB: db},
+       userSessions: &mysql.SessionModel{DB: db},
        users: &mysql.UserModel{DB: db},
+       verifyKey: verifyKey([]byte(*secret)),
+       verifyLifetime: cfg.VerifyLifetime,
+       // Each address can be sent one new verification link a minute.
+       verifyLimiter: newLimiter(1, 1, cfg.RateLimitIdle),
+   }
+
+   // Start the background worker which removes expired quotes and empties
+   // old items out of the trash.
+   rp, err := newReaper(&mysql.SnippetModel{DB: db}, errorLog, infoLog, cfg)
+   if err != nil {
+      errorLog.Fatal(err)
    }
+   rp.start()
+   dp.start()
 
    // Initialize a tls.Config struct to hold the non-default TLS settings we want
    // the server to use.
@@ -150,6 +370,26 @@ func main() {
       WriteTimeout: 10 * time.Second,
    }
 
+   // Live update streams never go idle, so end them as soon as shutdown
+   // begins rather than letting them hold it up.
+   srv.RegisterOnShutdown(app.broadcaster.close)
+
+   // Wait in the background for SIGINT or SIGTERM, and when one arrives
+   // give in-flight requests up to 20 seconds to complete before the server
+   // closes. Shutdown() makes ListenAndServeTLS() return straight away, so the
+   // result is passed back over a channel for main() to wait on.
+   shutdownErr := make(chan error)
+   go func() {
+      quit := make(chan os.Signal, 1)
+      signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+      sig := <-quit
+      infoLog.Printf("Caught %s, shutting down", sig)
+
+      ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+      defer cancel()
+      shutdownErr <- srv.Shutdown(ctx)
+   }()
+
    infoLog.Printf("Starting server on %s", cfg.Addr)
 
    // Use the ListenAndServeTLS() method to start the HTTPS server. We
@@ -157,7 +397,17 @@ func main() {
    // the two parameters.
    //err = srv.ListenAndServe()
    err = srv.ListenAndServeTLS("./tls/cert.pem", "./tls/key.pem")
-   errorLog.Fatal(err)
+   if err != http.ErrServerClosed {
+      errorLog.Fatal(err)
+   }
+   if err = <-shutdownErr; err != nil {
+      errorLog.Fatal(err)
+   }
+
+   // Stop the background workers once the last request has been served.
+   rp.stop()
+   dp.stop()
+   infoLog.Print("Server stopped")
 }
 
 func openDB(dsn string) (*sql.DB, error) {
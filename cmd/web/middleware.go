@@ -4,6 +4,7 @@ import (
     "context"
     "fmt"
     "net/http"
+    "time"
 
     "cb.net/snippetbox/pkg/models"
     "github.com/justinas/nosurf"
@@ -91,20 +92,43 @@ func (app *application) authenticate(next http.Handler) http.Handler {
     // (invalid) authenticatedUserID value from their session and call the next
     // handler in the chain as normal.
     user, err := app.users.Get(app.session.GetInt(r, "authenticatedUserID"))
-    if err == models.ErrNoRecord || !user.Active {
+    if err != nil && err != models.ErrNoRecord {
+        app.serverError(w, err)
+        return
+    } else if err == models.ErrNoRecord || !user.Active {
         app.session.Remove(r, "authenticatedUserID")
         next.ServeHTTP(w, r)
         return
-    } else if err != nil {
+    }
+
+    // The cookie alone isn't enough: the session it belongs to must also
+    // still be recorded, and not revoked, on the server. Cookies without a
+    // session token, from before sessions were recorded, are logged out too.
+    sess, err := app.userSessions.Get(app.session.GetString(r, "sessionToken"))
+    if err != nil && err != models.ErrNoRecord {
         app.serverError(w, err)
         return
+    } else if err == models.ErrNoRecord || sess.UserID != user.ID {
+        app.endSession(r)
+        next.ServeHTTP(w, r)
+        return
+    }
+    if ip := remoteIP(r); ip != sess.IP || time.Since(sess.LastSeen) > sessionTouchInterval {
+        err = app.userSessions.Touch(sess.ID, ip)
+        if err != nil {
+            app.serverError(w, err)
+            return
+        }
     }
     
     // Otherwise, we know that the request is coming from a active, authenticated,
     // user. We create a new copy of the request, with a true boolean value
-    // added to the request context to indicate this, and call the next handler
-    // in the chain *using this new copy of the request*.
+    // added to the request context to indicate this, along with the user
+    // record itself for authorization checks and the session record, and call the next handler in the
+    // chain *using this new copy of the request*.
     ctx := context.WithValue(r.Context(), contextKeyIsAuthenticated, true)
+    ctx = context.WithValue(ctx, contextKeyUser, user)
+    ctx = context.WithValue(ctx, contextKeySession, sess)
         next.ServeHTTP(w, r.WithContext(ctx))
     })
 }
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"cb.net/snippetbox/pkg/models"
+	"cb.net/snippetbox/pkg/oidc"
+)
+
+// oidcTimeout limits each request made to an OpenID Connect provider.
+const oidcTimeout = 10 * time.Second
+
+// providerIDRX matches provider IDs, which appear in login URLs.
+var providerIDRX = regexp.MustCompile("^[a-z0-9-]+$")
+
+// Errors returned by oidcUser when an external identity can't be used to
+// log in.
+var (
+	errUnverifiedIdentity = errors.New("identity has no verified email address")
+	errNoAccount          = errors.New("no account for identity")
+)
+
+// providerConfig is an entry in the -oidc-providers file, which holds a
+// JSON array of them.
+type providerConfig struct {
+	// ID names the provider in its login and callback URLs, and Name is
+	// shown on the login page.
+	ID   string `json:"id"`
+	Name string `json:"name"`
+
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	Scopes       []string `json:"scopes"`
+
+	// CreateUsers lets people without an account sign up by logging in
+	// through the provider. Otherwise they need an existing account with
+	// the same email address.
+	CreateUsers bool `json:"create_users"`
+}
+
+// oidcProvider is an external OpenID Connect provider users can log in
+// with. Accounts with a provider are linked to users by email address, so
+// only providers trusted to verify the addresses they vouch for should be
+// configured.
+type oidcProvider struct {
+	ID          string
+	Name        string
+	CreateUsers bool
+	*oidc.Provider
+}
+
+// loadOIDCProviders reads the providers configured in the file at path.
+// Each provider must be registered with a redirect URL of
+// /user/oidc/<id>/callback on siteURL.
+func loadOIDCProviders(path string, siteURL *url.URL) ([]*oidcProvider, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var configs []*providerConfig
+	err = json.NewDecoder(f).Decode(&configs)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	client := &http.Client{Timeout: oidcTimeout}
+	seen := make(map[string]bool)
+	var providers []*oidcProvider
+	for _, c := range configs {
+		switch {
+		case !providerIDRX.MatchString(c.ID):
+			return nil, fmt.Errorf("%s: provider ID %q must be lower case letters, digits and dashes", path, c.ID)
+		case seen[c.ID]:
+			return nil, fmt.Errorf("%s: provider ID %q is used twice", path, c.ID)
+		case c.Name == "" || c.Issuer == "" || c.ClientID == "":
+			return nil, fmt.Errorf("%s: provider %q needs a name, issuer and client_id", path, c.ID)
+		}
+		seen[c.ID] = true
+
+		redirect := siteURL.ResolveReference(&url.URL{Path: "/user/oidc/" + c.ID + "/callback"})
+		providers = append(providers, &oidcProvider{
+			ID:          c.ID,
+			Name:        c.Name,
+			CreateUsers: c.CreateUsers,
+			Provider: oidc.New(oidc.Config{
+				Issuer:       c.Issuer,
+				ClientID:     c.ClientID,
+				ClientSecret: c.ClientSecret,
+				RedirectURL:  redirect.String(),
+				Scopes:       append([]string{"email", "profile"}, c.Scopes...),
+			}, client),
+		})
+	}
+	return providers, nil
+}
+
+// provider returns the OpenID Connect provider with the given ID, or nil if
+// there isn't one.
+func (app *application) provider(id string) *oidcProvider {
+	for _, p := range app.oidcProviders {
+		if p.ID == id {
+			return p
+		}
+	}
+	return nil
+}
+
+// oidcLogin sends the user to a provider to log in. The state, nonce and
+// PKCE code verifier the provider's response is checked against are kept in
+// the session until they come back.
+func (app *application) oidcLogin(w http.ResponseWriter, r *http.Request) {
+	p := app.provider(r.URL.Query().Get(":provider"))
+	if p == nil {
+		app.notFound(w)
+		return
+	}
+
+	var secrets [3]string
+	for i := range secrets {
+		s, err := oidc.RandomString()
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		secrets[i] = s
+	}
+	state, nonce, verifier := secrets[0], secrets[1], secrets[2]
+
+	authURL, err := p.AuthURL(r.Context(), state, nonce, verifier)
+	if err != nil {
+		app.errorLog.Printf("OpenID Connect provider %s: %v", p.ID, err)
+		app.session.Put(r, "flash", "Logging in with "+p.Name+" isn't working right now. Please try again later.")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	app.session.Put(r, "oidcProvider", p.ID)
+	app.session.Put(r, "oidcState", state)
+	app.session.Put(r, "oidcNonce", nonce)
+	app.session.Put(r, "oidcVerifier", verifier)
+	http.Redirect(w, r, authURL, http.StatusSeeOther)
+}
+
+// oidcCallback is where a provider sends the user back to. The code it
+// sends with them is exchanged for an ID token, and the user is logged in
+// to the account the identity in the token is linked to.
+func (app *application) oidcCallback(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	p := app.provider(q.Get(":provider"))
+	if p == nil {
+		app.notFound(w)
+		return
+	}
+
+	// Each login attempt can only be completed once, and only through the
+	// provider it was started with.
+	providerID := app.session.PopString(r, "oidcProvider")
+	state := app.session.PopString(r, "oidcState")
+	nonce := app.session.PopString(r, "oidcNonce")
+	verifier := app.session.PopString(r, "oidcVerifier")
+	if providerID != p.ID || state == "" || subtle.ConstantTimeCompare([]byte(q.Get("state")), []byte(state)) != 1 {
+		app.session.Put(r, "flash", "Your login attempt has expired. Please try again.")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+	if q.Get("error") != "" {
+		app.infoLog.Printf("OpenID Connect provider %s: login failed: %s", p.ID, q.Get("error"))
+		app.session.Put(r, "flash", "Logging in with "+p.Name+" was cancelled or failed.")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	claims, err := p.Exchange(r.Context(), q.Get("code"), verifier, nonce)
+	if err != nil {
+		app.errorLog.Printf("OpenID Connect provider %s: %v", p.ID, err)
+		app.session.Put(r, "flash", "We couldn't log you in with "+p.Name+". Please try again.")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	id, err := app.oidcUser(p, claims)
+	if err == errUnverifiedIdentity {
+		app.session.Put(r, "flash", p.Name+" didn't give us a verified email address, so we can't log you in with it.")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	} else if err == errNoAccount {
+		app.session.Put(r, "flash", "There is no Quotebox account for "+claims.Email+". Please sign up first.")
+		http.Redirect(w, r, "/user/signup", http.StatusSeeOther)
+		return
+	} else if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	// Two-factor authentication still applies, just as it does after a
+	// password.
+	secret, err := app.twoFactor.Secret(id)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	if secret != "" {
+		app.beginTwoFactorLogin(w, r, id)
+		return
+	}
+	app.completeLogin(w, r, id)
+}
+
+// oidcUser returns the ID of the user an external identity belongs to. An
+// identity which hasn't been seen before is linked to the user with the
+// same email address, provided the provider has verified it, or to a new
+// user if the provider allows it. Either way the email address counts as
+// verified, so an account still waiting for that is marked as verified.
+func (app *application) oidcUser(p *oidcProvider, c *oidc.Claims) (int, error) {
+	id, err := app.identities.Get(c.Issuer, c.Subject)
+	if err != models.ErrNoRecord {
+		return id, err
+	}
+	if c.Email == "" || !c.EmailVerified {
+		return 0, errUnverifiedIdentity
+	}
+
+	u, err := app.users.GetByEmail(c.Email)
+	if err == models.ErrNoRecord {
+		if !p.CreateUsers {
+			return 0, errNoAccount
+		}
+		name := c.Name
+		if name == "" {
+			name = strings.SplitN(c.Email, "@", 2)[0]
+		}
+		id, err = app.users.InsertExternal(name, c.Email)
+		if err != nil {
+			return 0, err
+		}
+		app.infoLog.Printf("Created user %d for %s identity %s", id, p.ID, c.Subject)
+	} else if err != nil {
+		return 0, err
+	} else {
+		id = u.ID
+		if !u.EmailVerified {
+			// Whoever signed up for the account never proved that the
+			// address was theirs, so the password they chose is replaced
+			// before the account is handed to the address's real owner.
+			password, err := oidc.RandomString()
+			if err != nil {
+				return 0, err
+			}
+			err = app.users.SetPassword(u.ID, password)
+			if err != nil {
+				return 0, err
+			}
+			err = app.users.VerifyEmail(u.ID, u.Email)
+			if err != nil && err != models.ErrNoRecord {
+				return 0, err
+			}
+		}
+	}
+
+	err = app.identities.Insert(id, c.Issuer, c.Subject, c.Email)
+	if err != nil {
+		return 0, err
+	}
+	app.infoLog.Printf("Linked %s identity %s to user %d", p.ID, c.Subject, id)
+	return id, nil
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"cb.net/snippetbox/pkg/models"
+	"cb.net/snippetbox/pkg/models/mysql"
+	"cb.net/snippetbox/pkg/oidc/oidctest"
+
+	"github.com/bmizerany/pat"
+	"github.com/golangcollege/sessions"
+)
+
+// fakeUsers holds users in memory. Only the methods logging in with a
+// provider uses are implemented; the embedded model has no database, so
+// calling any other panics.
+type fakeUsers struct {
+	*mysql.UserModel
+	users     []*models.User
+	passwords map[int]string
+}
+
+func (f *fakeUsers) GetByEmail(email string) (*models.User, error) {
+	for _, u := range f.users {
+		if u.Email == email {
+			return u, nil
+		}
+	}
+	return nil, models.ErrNoRecord
+}
+
+func (f *fakeUsers) InsertExternal(name, email string) (int, error) {
+	u := &models.User{ID: 100 + len(f.users), Name: name, Email: email, Active: true, EmailVerified: true}
+	f.users = append(f.users, u)
+	return u.ID, nil
+}
+
+func (f *fakeUsers) SetPassword(id int, password string) error {
+	f.passwords[id] = password
+	return nil
+}
+
+func (f *fakeUsers) VerifyEmail(id int, email string) error {
+	for _, u := range f.users {
+		if u.ID == id && u.Email == email && !u.EmailVerified {
+			u.EmailVerified = true
+			return nil
+		}
+	}
+	return models.ErrNoRecord
+}
+
+func (f *fakeUsers) ResetLoginFailures(id int) error {
+	return nil
+}
+
+// fakeIdentities links identities, keyed by issuer and subject, to users.
+type fakeIdentities map[[2]string]int
+
+func (f fakeIdentities) Get(issuer, subject string) (int, error) {
+	id, ok := f[[2]string{issuer, subject}]
+	if !ok {
+		return 0, models.ErrNoRecord
+	}
+	return id, nil
+}
+
+func (f fakeIdentities) Insert(userID int, issuer, subject, email string) error {
+	f[[2]string{issuer, subject}] = userID
+	return nil
+}
+
+type fakeTwoFactor struct {
+	*mysql.TwoFactorModel
+	secrets map[int]string
+}
+
+func (f *fakeTwoFactor) Secret(id int) (string, error) {
+	return f.secrets[id], nil
+}
+
+// fakeSessions records which users sessions were started for.
+type fakeSessions struct {
+	*mysql.SessionModel
+	started []int
+}
+
+func (f *fakeSessions) Insert(userID int, ip, userAgent string, lifetime time.Duration) (string, error) {
+	f.started = append(f.started, userID)
+	return "token", nil
+}
+
+func TestOIDCLogin(t *testing.T) {
+	provider := oidctest.NewServer("quotebox", "client-secret")
+	defer provider.Close()
+
+	tests := []struct {
+		name         string
+		identity     oidctest.Identity
+		linked       int
+		unverified   bool
+		createUsers  bool
+		clientSecret string
+		badState     bool
+		twoFactor    bool
+		wantLocation string
+		wantUser     int
+		wantLinked   int
+	}{
+		{
+			name:         "Verified email linked",
+			identity:     oidctest.Identity{Subject: "s1", Email: "alice@example.com", EmailVerified: true},
+			wantLocation: "/snippet/create",
+			wantUser:     1,
+			wantLinked:   1,
+		},
+		{
+			name:         "Unverified account verified",
+			identity:     oidctest.Identity{Subject: "s1", Email: "alice@example.com", EmailVerified: true},
+			unverified:   true,
+			wantLocation: "/snippet/create",
+			wantUser:     1,
+			wantLinked:   1,
+		},
+		{
+			name:         "Link wins over a changed email",
+			identity:     oidctest.Identity{Subject: "s1", Email: "bob@example.com", EmailVerified: true},
+			linked:       1,
+			wantLocation: "/snippet/create",
+			wantUser:     1,
+			wantLinked:   1,
+		},
+		{
+			name:         "Unverified email refused",
+			identity:     oidctest.Identity{Subject: "s1", Email: "alice@example.com"},
+			wantLocation: "/user/login",
+		},
+		{
+			name:         "No account",
+			identity:     oidctest.Identity{Subject: "s1", Email: "carol@example.com", EmailVerified: true},
+			wantLocation: "/user/signup",
+		},
+		{
+			name:         "No account with create_users",
+			identity:     oidctest.Identity{Subject: "s1", Email: "carol@example.com", EmailVerified: true, Name: "Carol"},
+			createUsers:  true,
+			wantLocation: "/snippet/create",
+			wantUser:     102,
+			wantLinked:   102,
+		},
+		{
+			name:         "Bad client secret",
+			identity:     oidctest.Identity{Subject: "s1", Email: "alice@example.com", EmailVerified: true},
+			clientSecret: "wrong",
+			wantLocation: "/user/login",
+		},
+		{
+			name:         "Bad state",
+			identity:     oidctest.Identity{Subject: "s1", Email: "alice@example.com", EmailVerified: true},
+			badState:     true,
+			wantLocation: "/user/login",
+		},
+		{
+			name:         "Two-factor authentication still applies",
+			identity:     oidctest.Identity{Subject: "s1", Email: "alice@example.com", EmailVerified: true},
+			twoFactor:    true,
+			wantLocation: "/user/login/2fa",
+			wantLinked:   1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users := &fakeUsers{
+				users: []*models.User{
+					{ID: 1, Name: "Alice", Email: "alice@example.com", Active: true, EmailVerified: !tt.unverified},
+					{ID: 2, Name: "Bob", Email: "bob@example.com", Active: true, EmailVerified: true},
+				},
+				passwords: map[int]string{},
+			}
+			identities := fakeIdentities{}
+			if tt.linked != 0 {
+				identities[[2]string{provider.Issuer(), tt.identity.Subject}] = tt.linked
+			}
+			twoFactor := &fakeTwoFactor{secrets: map[int]string{}}
+			if tt.twoFactor {
+				twoFactor.secrets[1] = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+			}
+			userSessions := &fakeSessions{}
+
+			discard := log.New(ioutil.Discard, "", 0)
+			app := &application{
+				errorLog:     discard,
+				infoLog:      discard,
+				identities:   identities,
+				ipFailures:   newFailureCounter(10, time.Minute, time.Hour),
+				session:      sessions.New([]byte("s6Ndh+pPbnzHbS*+9Pk8qGWhTzbpa@ge")),
+				twoFactor:    twoFactor,
+				userSessions: userSessions,
+				users:        users,
+			}
+			mux := pat.New()
+			mux.Get("/user/oidc/:provider", http.HandlerFunc(app.oidcLogin))
+			mux.Get("/user/oidc/:provider/callback", http.HandlerFunc(app.oidcCallback))
+			ts := httptest.NewServer(app.session.Enable(mux))
+			defer ts.Close()
+
+			// The providers are loaded the same way as in main, once the
+			// site's URL is known.
+			secret := tt.clientSecret
+			if secret == "" {
+				secret = provider.ClientSecret
+			}
+			app.siteURL, _ = url.Parse(ts.URL)
+			app.oidcProviders = testProviders(t, app.siteURL, &providerConfig{
+				ID:           "test",
+				Name:         "Test",
+				Issuer:       provider.Issuer(),
+				ClientID:     provider.ClientID,
+				ClientSecret: secret,
+				CreateUsers:  tt.createUsers,
+			})
+			provider.SetIdentity(tt.identity)
+
+			// Follow the redirects to the provider and back, and stop at the
+			// first one which leads anywhere else.
+			jar, _ := cookiejar.New(nil)
+			client := &http.Client{
+				Jar: jar,
+				CheckRedirect: func(req *http.Request, via []*http.Request) error {
+					if strings.HasPrefix(req.URL.String(), provider.URL+"/") {
+						return nil
+					}
+					if strings.HasPrefix(req.URL.Path, "/user/oidc/") {
+						if tt.badState {
+							q := req.URL.Query()
+							q.Set("state", "forged")
+							req.URL.RawQuery = q.Encode()
+						}
+						return nil
+					}
+					return http.ErrUseLastResponse
+				},
+			}
+			resp, err := client.Get(ts.URL + "/user/oidc/test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if got := resp.Header.Get("Location"); got != tt.wantLocation {
+				t.Errorf("want redirect to %q; got %d to %q", tt.wantLocation, resp.StatusCode, got)
+			}
+
+			var wantStarted []int
+			if tt.wantUser != 0 {
+				wantStarted = []int{tt.wantUser}
+			}
+			if !reflect.DeepEqual(userSessions.started, wantStarted) {
+				t.Errorf("want sessions started for %v; got %v", wantStarted, userSessions.started)
+			}
+
+			linked, _ := identities.Get(provider.Issuer(), tt.identity.Subject)
+			if linked != tt.wantLinked {
+				t.Errorf("want identity linked to user %d; got %d", tt.wantLinked, linked)
+			}
+
+			// An account nobody had proved the address of is handed over
+			// with a new password.
+			if tt.unverified {
+				if !users.users[0].EmailVerified || users.passwords[1] == "" {
+					t.Errorf("want the address verified with a new password; got verified %v, password %q", users.users[0].EmailVerified, users.passwords[1])
+				}
+			} else if len(users.passwords) > 0 {
+				t.Errorf("want passwords left alone; got %v", users.passwords)
+			}
+		})
+	}
+}
+
+// testProviders writes configs to a providers file and loads it.
+func testProviders(t *testing.T, siteURL *url.URL, configs ...*providerConfig) []*oidcProvider {
+	path := filepath.Join(t.TempDir(), "providers.json")
+	b, err := json.Marshal(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path, b, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	providers, err := loadOIDCProviders(path, siteURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return providers
+}
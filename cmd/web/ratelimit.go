@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// limiter is an in-memory token bucket rate limiter holding a bucket for
+// each client. Every bucket starts full with burst tokens and refills at
+// rate tokens per second, and each request takes one token. Buckets which
+// have been left alone for longer than idle are full again and carry no
+// state worth keeping, so they are evicted to stop the store from growing
+// without bound.
+type limiter struct {
+	rate  float64
+	burst float64
+	idle  time.Duration
+
+	// now returns the current time. It is a field so that the clock can be
+	// replaced when testing.
+	now func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newLimiter returns a limiter allowing perMinute requests a minute from
+// each client, in bursts of up to burst requests. It returns nil, which
+// disables limiting, if perMinute is zero.
+func newLimiter(perMinute, burst int, idle time.Duration) *limiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &limiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(burst),
+		idle:    idle,
+		now:     time.Now,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// allow takes a token from the bucket for key. If the bucket is empty it
+// returns false along with how long the client must wait for the next one.
+func (l *limiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Sub(l.swept) > l.idle {
+		l.evict(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// evict removes the buckets which haven't been used within the idle window.
+// It is called from allow at most once per window, so the cost of sweeping
+// the store is spread thinly across requests. The caller must hold l.mu.
+func (l *limiter) evict(now time.Time) {
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > l.idle {
+			delete(l.buckets, key)
+		}
+	}
+	l.swept = now
+}
+
+// rateLimit returns middleware which limits requests using l. Clients are
+// identified by their user ID when authenticated, and by IP address
+// otherwise, so it must come after the authentication middleware in the
+// chain. Rejected requests get a 429 response with a Retry-After header. A
+// nil limiter lets every request through.
+func (app *application) rateLimit(l *limiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if l == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ok, wait := l.allow(app.clientKey(r))
+			if ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			if strings.HasPrefix(r.URL.Path, "/api/") {
+				app.apiError(w, http.StatusTooManyRequests, "rate limit exceeded")
+				return
+			}
+			app.clientError(w, http.StatusTooManyRequests)
+		})
+	}
+}
+
+// clientKey identifies the client making a request for rate limiting.
+func (app *application) clientKey(r *http.Request) string {
+	if user := app.authenticatedUser(r); user != nil {
+		return fmt.Sprintf("user:%d", user.ID)
+	}
+	return "ip:" + remoteIP(r)
+}
+
+// remoteIP returns the IP address a request came from.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
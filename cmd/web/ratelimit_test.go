@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock which only moves when told to.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func TestLimiterAllow(t *testing.T) {
+	// One token a second, in bursts of up to three.
+	l := newLimiter(60, 3, 10*time.Minute)
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	l.now = clock.now
+
+	steps := []struct {
+		name     string
+		advance  time.Duration
+		key      string
+		wantOK   bool
+		wantWait time.Duration
+	}{
+		{"First of burst", 0, "a", true, 0},
+		{"Second of burst", 0, "a", true, 0},
+		{"Third of burst", 0, "a", true, 0},
+		{"Bucket empty", 0, "a", false, time.Second},
+		{"Other clients unaffected", 0, "b", true, 0},
+		{"Half refilled", 500 * time.Millisecond, "a", false, 500 * time.Millisecond},
+		{"Refilled", 500 * time.Millisecond, "a", true, 0},
+		{"Empty again", 0, "a", false, time.Second},
+		{"Refill is capped at burst", time.Minute, "a", true, 0},
+		{"Second after refill", 0, "a", true, 0},
+		{"Third after refill", 0, "a", true, 0},
+		{"Fourth after refill", 0, "a", false, time.Second},
+	}
+
+	for _, st := range steps {
+		clock.advance(st.advance)
+		ok, wait := l.allow(st.key)
+		if ok != st.wantOK || wait != st.wantWait {
+			t.Errorf("%s: want (%v, %v); got (%v, %v)", st.name, st.wantOK, st.wantWait, ok, wait)
+		}
+	}
+}
+
+func TestLimiterEvict(t *testing.T) {
+	l := newLimiter(60, 3, 10*time.Minute)
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	l.now = clock.now
+
+	l.allow("idle")
+	clock.advance(6 * time.Minute)
+	l.allow("recent")
+	clock.advance(6 * time.Minute)
+	l.allow("new")
+
+	for key, want := range map[string]bool{"idle": false, "recent": true, "new": true} {
+		if _, ok := l.buckets[key]; ok != want {
+			t.Errorf("bucket %q kept: want %v; got %v", key, want, ok)
+		}
+	}
+}
+
+func TestNewLimiter(t *testing.T) {
+	if l := newLimiter(0, 5, time.Minute); l != nil {
+		t.Error("want a nil limiter for a rate of zero")
+	}
+	if l := newLimiter(10, 0, time.Minute); l.burst != 1 {
+		t.Errorf("want burst of 1; got %v", l.burst)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	app := &application{}
+	l := newLimiter(60, 1, time.Minute)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+	h := app.rateLimit(l)(next)
+
+	tests := []struct {
+		name           string
+		remoteAddr     string
+		wantCode       int
+		wantRetryAfter string
+	}{
+		{"First request", "192.0.2.1:1234", http.StatusOK, ""},
+		{"Limited", "192.0.2.1:5678", http.StatusTooManyRequests, "1"},
+		{"Other address", "192.0.2.2:1234", http.StatusOK, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/user/login", nil)
+			r.RemoteAddr = tt.remoteAddr
+			h.ServeHTTP(rr, r)
+
+			if rr.Code != tt.wantCode {
+				t.Errorf("want %d; got %d", tt.wantCode, rr.Code)
+			}
+			if got := rr.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Errorf("want Retry-After %q; got %q", tt.wantRetryAfter, got)
+			}
+		})
+	}
+
+	// A nil limiter lets everything through.
+	h = app.rateLimit(nil)(next)
+	for i := 0; i < 5; i++ {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", "/user/login", nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("want %d; got %d", http.StatusOK, rr.Code)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// purger is the part of the snippet store the reaper needs.
+type purger interface {
+	PurgeExpired(time.Time, int, bool) (int, error)
+	PurgeDeleted(time.Time) (int, error)
+}
+
+// reaper is a background worker that permanently removes expired quotes,
+// and quotes that have outstayed the trash retention window, on a fixed
+// interval. Expired quotes are removed in batches so that a large backlog
+// never holds locks on the snippets table for long.
+type reaper struct {
+	snippets purger
+	errorLog *log.Logger
+	infoLog  *log.Logger
+
+	// interval is the time between passes, batchSize the maximum number of
+	// quotes removed per statement, and archive whether expired quotes are
+	// copied to the archive table before they are deleted.
+	interval       time.Duration
+	batchSize      int
+	archive        bool
+	trashRetention time.Duration
+
+	// now returns the current time. It is a field so that the clock can be
+	// replaced when testing.
+	now func() time.Time
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+// newReaper returns a reaper for the snippets in store, configured from
+// cfg's reap and trash settings, which must all be positive. A zero trash
+// retention in particular would empty the trash as soon as anything was put
+// in it.
+func newReaper(store purger, errorLog, infoLog *log.Logger, cfg *Config) (*reaper, error) {
+	if cfg.ReapInterval <= 0 || cfg.ReapBatchSize < 1 {
+		return nil, errors.New("reap-interval and reap-batch must be positive")
+	}
+	if cfg.TrashRetention <= 0 {
+		return nil, errors.New("trash-retention must be positive")
+	}
+	return &reaper{
+		snippets:       store,
+		errorLog:       errorLog,
+		infoLog:        infoLog,
+		interval:       cfg.ReapInterval,
+		batchSize:      cfg.ReapBatchSize,
+		archive:        cfg.ReapArchive,
+		trashRetention: cfg.TrashRetention,
+		now:            time.Now,
+	}, nil
+}
+
+// start runs a pass immediately and then once every interval, in a new
+// goroutine, until stop is called.
+func (rp *reaper) start() {
+	rp.quit = make(chan struct{})
+	rp.done = make(chan struct{})
+	go rp.run()
+}
+
+// stop signals the worker to finish and waits for any pass in progress to
+// complete its current batch.
+func (rp *reaper) stop() {
+	close(rp.quit)
+	<-rp.done
+}
+
+func (rp *reaper) run() {
+	defer close(rp.done)
+
+	ticker := time.NewTicker(rp.interval)
+	defer ticker.Stop()
+
+	for {
+		rp.reap()
+		select {
+		case <-ticker.C:
+		case <-rp.quit:
+			return
+		}
+	}
+}
+
+// reap makes a single pass, removing expired quotes batch by batch until
+// there are none left or the worker is told to stop, and then purging the
+// trash.
+func (rp *reaper) reap() {
+	now := rp.now().UTC()
+
+	expired := 0
+	for {
+		n, err := rp.snippets.PurgeExpired(now, rp.batchSize, rp.archive)
+		if err != nil {
+			rp.errorLog.Print(err)
+			break
+		}
+		expired += n
+		if n < rp.batchSize || rp.stopping() {
+			break
+		}
+	}
+	if expired > 0 {
+		if rp.archive {
+			rp.infoLog.Printf("Archived %d expired quotes", expired)
+		} else {
+			rp.infoLog.Printf("Purged %d expired quotes", expired)
+		}
+	}
+
+	trashed, err := rp.snippets.PurgeDeleted(now.Add(-rp.trashRetention))
+	if err != nil {
+		rp.errorLog.Print(err)
+	} else if trashed > 0 {
+		rp.infoLog.Printf("Purged %d quotes from the trash", trashed)
+	}
+}
+
+// stopping reports whether stop has been called.
+func (rp *reaper) stopping() bool {
+	select {
+	case <-rp.quit:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// purgeCall records the arguments of a call to PurgeExpired.
+type purgeCall struct {
+	cutoff  time.Time
+	batch   int
+	archive bool
+}
+
+// fakePurger returns the given batch sizes from successive PurgeExpired
+// calls, and 0 once they run out.
+type fakePurger struct {
+	batches []int
+	err     error
+
+	expired []purgeCall
+	deleted []time.Time
+}
+
+func (f *fakePurger) PurgeExpired(cutoff time.Time, batch int, archive bool) (int, error) {
+	f.expired = append(f.expired, purgeCall{cutoff, batch, archive})
+	if f.err != nil {
+		return 0, f.err
+	}
+	if len(f.batches) == 0 {
+		return 0, nil
+	}
+	n := f.batches[0]
+	f.batches = f.batches[1:]
+	return n, nil
+}
+
+func (f *fakePurger) PurgeDeleted(cutoff time.Time) (int, error) {
+	f.deleted = append(f.deleted, cutoff)
+	return 2, nil
+}
+
+func testReaper(t *testing.T, store purger) *reaper {
+	discard := log.New(ioutil.Discard, "", 0)
+	cfg := &Config{ReapInterval: time.Hour, ReapBatchSize: 3, ReapArchive: true, TrashRetention: 30 * 24 * time.Hour}
+	rp, err := newReaper(store, discard, discard, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rp
+}
+
+func TestReaperReap(t *testing.T) {
+	// The clock is deliberately not in UTC, to check that the cutoffs are.
+	zone := time.FixedZone("UTC+2", 2*60*60)
+	now := time.Date(2024, 3, 10, 14, 30, 0, 0, zone)
+	cutoff := now.UTC()
+
+	tests := []struct {
+		name      string
+		batches   []int
+		err       error
+		wantCalls int
+	}{
+		{"Nothing expired", nil, nil, 1},
+		{"Short first batch", []int{2}, nil, 1},
+		{"Full batches then short", []int{3, 3, 1}, nil, 3},
+		{"Full batches then empty", []int{3, 3, 3}, nil, 4},
+		{"Error", []int{3, 3}, errors.New("database is down"), 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &fakePurger{batches: tt.batches, err: tt.err}
+			rp := testReaper(t, store)
+			rp.now = func() time.Time { return now }
+
+			rp.reap()
+
+			if len(store.expired) != tt.wantCalls {
+				t.Fatalf("want %d PurgeExpired calls; got %d", tt.wantCalls, len(store.expired))
+			}
+			for _, call := range store.expired {
+				want := purgeCall{cutoff, 3, true}
+				if !reflect.DeepEqual(call, want) {
+					t.Errorf("want PurgeExpired%v; got PurgeExpired%v", want, call)
+				}
+			}
+
+			// The trash is emptied even if purging expired quotes failed.
+			wantDeleted := []time.Time{cutoff.Add(-30 * 24 * time.Hour)}
+			if !reflect.DeepEqual(store.deleted, wantDeleted) {
+				t.Errorf("want PurgeDeleted cutoffs %v; got %v", wantDeleted, store.deleted)
+			}
+		})
+	}
+}
+
+func TestReaperReapStopping(t *testing.T) {
+	store := &fakePurger{batches: []int{3, 3, 3, 3}}
+	rp := testReaper(t, store)
+	rp.quit = make(chan struct{})
+	close(rp.quit)
+
+	rp.reap()
+
+	// A full batch would normally be followed by another, but not once the
+	// reaper has been told to stop.
+	if len(store.expired) != 1 {
+		t.Errorf("want 1 PurgeExpired call; got %d", len(store.expired))
+	}
+}
+
+func TestNewReaper(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{"Valid", Config{ReapInterval: time.Hour, ReapBatchSize: 500, TrashRetention: time.Hour}, false},
+		{"Zero interval", Config{ReapInterval: 0, ReapBatchSize: 500, TrashRetention: time.Hour}, true},
+		{"Zero batch size", Config{ReapInterval: time.Hour, ReapBatchSize: 0, TrashRetention: time.Hour}, true},
+		{"Zero trash retention", Config{ReapInterval: time.Hour, ReapBatchSize: 500, TrashRetention: 0}, true},
+		{"Negative trash retention", Config{ReapInterval: time.Hour, ReapBatchSize: 500, TrashRetention: -time.Hour}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newReaper(&fakePurger{}, nil, nil, &tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("want error %v; got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
     "net/http"
 
+    "cb.net/snippetbox/pkg/models"
     "github.com/bmizerany/pat"
     "github.com/justinas/alice"
 )
@@ -18,6 +19,19 @@ func (app *application) routes() http.Handler {
     // our dynamic application routes. For now, this chain will only contain
     // the session middleware but we'll add more to it later.
     dynamicMiddleware := alice.New(app.session.Enable, noSurf, app.authenticate)
+
+    // The JSON API is routed outside of the noSurf chain, as scripts have no
+    // CSRF token to send. Requests that change data must instead declare a
+    // JSON content type; see readJSON. Scripts authenticate with a bearer
+    // token, which takes precedence over any session cookie.
+    apiMiddleware := alice.New(app.session.Enable, app.authenticate, app.authenticateToken)
+    writeScope := app.requireScope(models.ScopeWrite)
+
+    // Rate limiters for the routes most open to abuse. These come after the
+    // authentication middleware in each chain, so that signed in users are
+    // limited by their user ID rather than their IP address.
+    loginLimit := app.rateLimit(app.loginLimiter)
+    postLimit := app.rateLimit(app.postLimiter)
     
     //mux := http.NewServeMux()
 
@@ -29,25 +43,87 @@ func (app *application) routes() http.Handler {
     // Add the requireAuthentication middleware to the chain.
     mux.Get("/snippet/create", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(app.createSnippetForm))
     // Add the requireAuthentication middleware to the chain.
-    mux.Post("/snippet/create", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(app.createSnippet))
+    mux.Post("/snippet/create", dynamicMiddleware.Append(app.requireAuthentication, postLimit).ThenFunc(app.createSnippet))
 
     mux.Get("/snippet/:id", dynamicMiddleware.ThenFunc(app.showSnippet))
+    mux.Get("/snippet/:id/edit", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(app.editSnippetForm))
+    mux.Post("/snippet/:id/edit", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(app.editSnippet))
+    mux.Post("/snippet/:id/delete", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(app.deleteSnippet))
+    mux.Get("/snippet/:id/history", dynamicMiddleware.ThenFunc(app.snippetHistory))
+    mux.Get("/snippet/:id/diff", dynamicMiddleware.ThenFunc(app.snippetDiff))
+    mux.Post("/snippet/:id/history/:rev/restore", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(app.restoreRevision))
+    mux.Get("/s/:slug", dynamicMiddleware.ThenFunc(app.showSharedSnippet))
+    mux.Get("/author/:id", dynamicMiddleware.ThenFunc(app.showAuthor))
+    mux.Get("/tag/:name", dynamicMiddleware.ThenFunc(app.showTag))
+
+    // Feeds don't use sessions, so they sit outside the dynamic chain.
+    mux.Get("/feed.atom", http.HandlerFunc(app.latestFeed))
+    mux.Get("/feed.rss", http.HandlerFunc(app.latestFeed))
+    mux.Get("/author/:id/feed.atom", http.HandlerFunc(app.authorFeed))
+    mux.Get("/author/:id/feed.rss", http.HandlerFunc(app.authorFeed))
+    mux.Get("/tag/:name/feed.atom", http.HandlerFunc(app.tagFeed))
+    mux.Get("/tag/:name/feed.rss", http.HandlerFunc(app.tagFeed))
+
+    // Embeds and oEmbed are also served without sessions; see renderEmbed.
+    mux.Get("/snippet/:id/embed", http.HandlerFunc(app.embedSnippet))
+    mux.Get("/s/:slug/embed", http.HandlerFunc(app.embedSharedSnippet))
+    mux.Get("/oembed", http.HandlerFunc(app.oembed))
+
+    // Live updates for the home page; see events.
+    mux.Get("/events", http.HandlerFunc(app.events))
+    mux.Get("/search", dynamicMiddleware.ThenFunc(app.search))
 
     // User routes.
     mux.Get("/user/signup", dynamicMiddleware.ThenFunc(app.signupUserForm))
-    mux.Post("/user/signup", dynamicMiddleware.ThenFunc(app.signupUser))
+    mux.Post("/user/signup", dynamicMiddleware.Append(loginLimit).ThenFunc(app.signupUser))
+    mux.Get("/user/verify", dynamicMiddleware.ThenFunc(app.verifyUser))
+    mux.Post("/user/verify/resend", dynamicMiddleware.Append(loginLimit).ThenFunc(app.resendVerification))
     mux.Get("/user/login", dynamicMiddleware.ThenFunc(app.loginUserForm))
-    mux.Post("/user/login", dynamicMiddleware.ThenFunc(app.loginUser))
+    mux.Post("/user/login", dynamicMiddleware.Append(loginLimit).ThenFunc(app.loginUser))
+    mux.Get("/user/login/2fa", dynamicMiddleware.ThenFunc(app.twoFactorLoginForm))
+    mux.Post("/user/login/2fa", dynamicMiddleware.Append(loginLimit).ThenFunc(app.twoFactorLogin))
+    mux.Get("/user/oidc/:provider", dynamicMiddleware.ThenFunc(app.oidcLogin))
+    mux.Get("/user/oidc/:provider/callback", dynamicMiddleware.Append(loginLimit).ThenFunc(app.oidcCallback))
     // Add the requireAuthentication middleware to the chain.
     mux.Post("/user/logout", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(app.logoutUser))
     // Add user profile 
     mux.Get("/user/profile", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(app.userProfile))
+    mux.Post("/user/sessions/:id/revoke", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(app.revokeSession))
+    mux.Post("/user/sessions/revoke-others", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(app.revokeOtherSessions))
+    mux.Get("/user/trash", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(app.userTrash))
+    mux.Post("/user/trash/:id/restore", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(app.restoreSnippet))
+    mux.Post("/user/trash/:id/purge", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(app.purgeSnippet))
+    mux.Get("/user/import", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(app.importForm))
+    mux.Post("/user/import", dynamicMiddleware.Append(app.requireAuthentication, postLimit).ThenFunc(app.importQuotes))
+    mux.Get("/user/export", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(app.exportQuotes))
+    mux.Get("/user/tokens", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(app.userTokens))
+    mux.Post("/user/tokens", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(app.createToken))
+    mux.Post("/user/tokens/:id/revoke", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(app.revokeToken))
+    mux.Get("/user/webhooks", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(app.userWebhooks))
+    mux.Post("/user/webhooks", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(app.createWebhook))
+    mux.Get("/user/webhooks/:id", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(app.showWebhook))
+    mux.Post("/user/webhooks/:id/delete", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(app.deleteWebhook))
+    mux.Post("/user/webhooks/:id/deliveries/:delivery/redeliver", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(app.redeliverWebhook))
+    mux.Get("/user/2fa", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(app.userTwoFactor))
+    mux.Post("/user/2fa", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(app.enableTwoFactor))
+    mux.Get("/user/2fa/qr", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(app.twoFactorQR))
+    mux.Post("/user/2fa/disable", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(app.disableTwoFactor))
+    mux.Post("/user/2fa/recovery-codes", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(app.regenerateRecoveryCodes))
     mux.Get("/user/change-password", dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(app.changePasswordForm))
     mux.Post("/user/change-password",  dynamicMiddleware.Append(app.requireAuthentication).ThenFunc(app.changePassword))
     mux.Get("/user/passwordreset", dynamicMiddleware.ThenFunc(app.passwordResetForm))
-    mux.Post("/user/passwordreset", dynamicMiddleware.ThenFunc(app.passwordReset))
-    mux.Get("/user/password/{id}", dynamicMiddleware.ThenFunc(app.password))
+    mux.Post("/user/passwordreset", dynamicMiddleware.Append(loginLimit).ThenFunc(app.passwordReset))
+    mux.Get("/user/password/:token", dynamicMiddleware.ThenFunc(app.newPasswordForm))
+    mux.Post("/user/password/:token", dynamicMiddleware.Append(loginLimit).ThenFunc(app.newPassword))
     
+    // JSON API routes.
+    mux.Get("/api/v1/snippets", apiMiddleware.ThenFunc(app.apiListSnippets))
+    mux.Post("/api/v1/snippets", apiMiddleware.Append(app.requireAPIAuthentication, writeScope, postLimit).ThenFunc(app.apiCreateSnippet))
+    mux.Get("/api/v1/snippets/:id", apiMiddleware.ThenFunc(app.apiShowSnippet))
+    mux.Put("/api/v1/snippets/:id", apiMiddleware.Append(app.requireAPIAuthentication, writeScope).ThenFunc(app.apiUpdateSnippet))
+    mux.Del("/api/v1/snippets/:id", apiMiddleware.Append(app.requireAPIAuthentication, writeScope).ThenFunc(app.apiDeleteSnippet))
+    mux.Post("/api/v1/token", apiMiddleware.Append(app.requireAPIAuthentication).ThenFunc(app.apiIssueToken))
+
     fileServer := http.FileServer(http.Dir("./ui/static/"))
     mux.Get("/static/", http.StripPrefix("/static", fileServer))
     
@@ -3,10 +3,14 @@ package main
 import (
    "html/template"
    "path/filepath"
+   "regexp"
+   "strings"
    "time"
 
+   "cb.net/snippetbox/pkg/diff"
    "cb.net/snippetbox/pkg/forms"
    "cb.net/snippetbox/pkg/models"
+   "cb.net/snippetbox/pkg/quotefile"
 )
 
 // Define a templateData type to act as the holding structure for
@@ -14,14 +18,47 @@ import (
 // At the moment it only contains one field, but we'll add more
 // to it as the build progresses.
 type templateData struct {
+   Author *models.Author
+   CanModify bool
    CSRFToken string
    CurrentYear int
+   Deliveries []*models.Delivery
+   Diff *revisionDiff
+   Events []string
    Flash string
    Form *forms.Form
+   Formats []string
    IsAuthenticated bool
+   NewToken string
+   NextPage int
+   Page *models.SnippetPage
+   PrevPage int
+   Providers []*oidcProvider
+   ResetToken string
+   Query string
+   Revisions []*models.Revision
+   SessionID int
+   Sessions []*models.Session
+   RowErrors []*quotefile.RowError
    Snippet *models.Snippet
    Snippets []*models.Snippet
+   Tag string
+   Tokens []*models.Token
+   TwoFactor *twoFactorStatus
+   TrashRetention time.Duration
    User *models.User
+   Webhook *models.Webhook
+   Webhooks []*models.Webhook
+}
+
+// revisionDiff holds the comparison between two revisions of a snippet. Mode
+// is either "words" or "lines".
+type revisionDiff struct {
+   From *models.Revision
+   To *models.Revision
+   Mode string
+   Title []diff.Op
+   Content []diff.Op
 }
 
 // Create a humanDate function which returns a nicely formatted string
@@ -30,10 +67,40 @@ func humanDate(t time.Time) string {
    return t.Format("02 Jan 2006 at 15:04")
 }
 
+// searchTermRX picks out the words of a search query, ignoring punctuation.
+var searchTermRX = regexp.MustCompile(`[\pL\pN]+`)
+
+// Create a highlight function which HTML-escapes text and wraps every
+// occurrence of the words in query in a <mark> element.
+func highlight(text, query string) template.HTML {
+   terms := searchTermRX.FindAllString(query, -1)
+   if len(terms) == 0 {
+      return template.HTML(template.HTMLEscapeString(text))
+   }
+   for i, term := range terms {
+      terms[i] = regexp.QuoteMeta(term)
+   }
+   rx := regexp.MustCompile(`(?i)` + strings.Join(terms, "|"))
+
+   var b strings.Builder
+   last := 0
+   for _, loc := range rx.FindAllStringIndex(text, -1) {
+      b.WriteString(template.HTMLEscapeString(text[last:loc[0]]))
+      b.WriteString("<mark>")
+      b.WriteString(template.HTMLEscapeString(text[loc[0]:loc[1]]))
+      b.WriteString("</mark>")
+      last = loc[1]
+   }
+   b.WriteString(template.HTMLEscapeString(text[last:]))
+   return template.HTML(b.String())
+}
+
 // Initialize a template.FuncMap object and store it in a global variable. This is
 // essentially a string-keyed map which acts as a lookup between the names of our
 // custom template functions and the functions themselves.
 var functions = template.FuncMap{
+   "device": describeUserAgent,
+   "highlight": highlight,
    "humanDate": humanDate,
 }
 
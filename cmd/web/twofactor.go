@@ -0,0 +1,391 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"cb.net/snippetbox/pkg/forms"
+	"cb.net/snippetbox/pkg/models"
+	"cb.net/snippetbox/pkg/totp"
+
+	"rsc.io/qr"
+)
+
+const (
+	// twoFactorIssuer is the name authenticator apps show against codes.
+	twoFactorIssuer = "Quotebox"
+
+	// recoveryCodeCount is how many recovery codes a user is given.
+	recoveryCodeCount = 10
+
+	// A user who has given the right password has twoFactorTimeout to enter
+	// a code, and twoFactorAttempts goes at it, before they have to start
+	// again with the password.
+	twoFactorTimeout  = 5 * time.Minute
+	twoFactorAttempts = 5
+)
+
+// twoFactorStatus holds what the two-factor authentication page shows:
+// either the state of two-factor authentication for a user who has it
+// turned on, or the secret for one who is setting it up. RecoveryCodes is
+// only filled in straight after they have been generated, as it is the only
+// time they are available.
+type twoFactorStatus struct {
+	Enabled       bool
+	CodesLeft     int
+	Secret        string
+	URI           string
+	RecoveryCodes []string
+}
+
+// newRecoveryCodes returns a fresh set of random recovery codes, each 80
+// bits written as four groups of four characters.
+func newRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		s := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		codes[i] = s[0:4] + "-" + s[4:8] + "-" + s[8:12] + "-" + s[12:16]
+	}
+	return codes, nil
+}
+
+// beginTwoFactorLogin is called once a user with two-factor authentication
+// has given the right password. Rather than logging them in, it remembers
+// who they are in the session and sends them on to enter a code.
+func (app *application) beginTwoFactorLogin(w http.ResponseWriter, r *http.Request, id int) {
+	app.session.Put(r, "twoFactorUserID", id)
+	app.session.Put(r, "twoFactorExpires", int(time.Now().Add(twoFactorTimeout).Unix()))
+	app.session.Remove(r, "twoFactorFailures")
+	http.Redirect(w, r, "/user/login/2fa", http.StatusSeeOther)
+}
+
+// pendingTwoFactor returns the ID of the user part way through logging in
+// with two-factor authentication, or 0 if there isn't one or they took too
+// long.
+func (app *application) pendingTwoFactor(r *http.Request) int {
+	id := app.session.GetInt(r, "twoFactorUserID")
+	if id == 0 || int64(app.session.GetInt(r, "twoFactorExpires")) < time.Now().Unix() {
+		return 0
+	}
+	return id
+}
+
+// endTwoFactorLogin forgets the user part way through logging in.
+func (app *application) endTwoFactorLogin(r *http.Request) {
+	app.session.Remove(r, "twoFactorUserID")
+	app.session.Remove(r, "twoFactorExpires")
+	app.session.Remove(r, "twoFactorFailures")
+}
+
+func (app *application) twoFactorLoginForm(w http.ResponseWriter, r *http.Request) {
+	if app.pendingTwoFactor(r) == 0 {
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+	app.render(w, r, "login2fa.page.tmpl", &templateData{Form: forms.New(nil)})
+}
+
+// twoFactorLogin is the second step of logging in for users with two-factor
+// authentication, taking either a code from their authenticator app or one
+// of their recovery codes.
+func (app *application) twoFactorLogin(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	id := app.pendingTwoFactor(r)
+	if id == 0 {
+		app.endTwoFactorLogin(r)
+		app.session.Put(r, "flash", "That took too long. Please log in again.")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	// Wrong codes count towards locking the account, just like wrong
+	// passwords, and a lockout stops the login part way through.
+	user, err := app.users.Get(id)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	allowed, failures, err := app.loginAllowed(r, user.Email)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	if !allowed {
+		app.endTwoFactorLogin(r)
+		app.session.Put(r, "flash", "Too many failed attempts. Please wait a while before logging in again.")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("code")
+	if !form.Valid() {
+		app.render(w, r, "login2fa.page.tmpl", &templateData{Form: form})
+		return
+	}
+
+	// Codes from the app are all digits; anything else is taken to be a
+	// recovery code.
+	code := strings.Replace(form.Get("code"), " ", "", -1)
+	usedRecoveryCode := strings.Trim(code, "0123456789") != ""
+	if usedRecoveryCode {
+		err = app.twoFactor.UseRecoveryCode(id, code)
+	} else {
+		var secret string
+		secret, err = app.twoFactor.Secret(id)
+		if err == nil {
+			if step, ok := totp.Validate(secret, code, time.Now()); ok {
+				err = app.twoFactor.UseStep(id, step)
+			} else {
+				err = models.ErrInvalidCredentials
+			}
+		}
+	}
+
+	if err == models.ErrInvalidCredentials {
+		if err = app.loginFailed(r, failures); err != nil {
+			app.serverError(w, err)
+			return
+		}
+		attempts := app.session.GetInt(r, "twoFactorFailures") + 1
+		if attempts >= twoFactorAttempts {
+			app.endTwoFactorLogin(r)
+			app.session.Put(r, "flash", "Too many incorrect codes. Please log in again.")
+			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+			return
+		}
+		app.session.Put(r, "twoFactorFailures", attempts)
+		form.Errors.Add("code", "This code is incorrect or has already been used")
+		app.render(w, r, "login2fa.page.tmpl", &templateData{Form: form})
+		return
+	} else if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.endTwoFactorLogin(r)
+
+	if usedRecoveryCode {
+		left, err := app.twoFactor.RecoveryCodesLeft(id)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		app.session.Put(r, "flash", recoveryCodesLeftMessage(left))
+	}
+	app.completeLogin(w, r, id)
+}
+
+// recoveryCodesLeftMessage warns a user who has just used a recovery code
+// how many they have left.
+func recoveryCodesLeftMessage(left int) string {
+	switch left {
+	case 0:
+		return "You have used your last recovery code. Generate some new ones on the two-factor authentication page."
+	case 1:
+		return "You have 1 recovery code left."
+	}
+	return fmt.Sprintf("You have %d recovery codes left.", left)
+}
+
+// userTwoFactor shows the two-factor authentication page. Users who haven't
+// turned it on are given a new secret to set up their authenticator app
+// with, which is kept in their session until they confirm it with a code.
+func (app *application) userTwoFactor(w http.ResponseWriter, r *http.Request) {
+	app.renderTwoFactor(w, r, forms.New(nil), nil)
+}
+
+func (app *application) renderTwoFactor(w http.ResponseWriter, r *http.Request, form *forms.Form, codes []string) {
+	user := app.authenticatedUser(r)
+	secret, err := app.twoFactor.Secret(user.ID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	status := &twoFactorStatus{RecoveryCodes: codes}
+	if secret != "" {
+		status.Enabled = true
+		status.CodesLeft, err = app.twoFactor.RecoveryCodesLeft(user.ID)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+	} else {
+		status.Secret = app.session.GetString(r, "twoFactorSetup")
+		if status.Secret == "" {
+			status.Secret, err = totp.NewSecret()
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			app.session.Put(r, "twoFactorSetup", status.Secret)
+		}
+		status.URI = totp.URI(twoFactorIssuer, user.Email, status.Secret)
+	}
+
+	// The page may show a secret or recovery codes, so shouldn't be kept.
+	w.Header().Set("Cache-Control", "no-store")
+	app.render(w, r, "twofactor.page.tmpl", &templateData{
+		Form:      form,
+		TwoFactor: status,
+	})
+}
+
+// twoFactorQR serves the QR code for setting up an authenticator app with
+// the secret in the user's session.
+func (app *application) twoFactorQR(w http.ResponseWriter, r *http.Request) {
+	secret := app.session.GetString(r, "twoFactorSetup")
+	if secret == "" {
+		app.notFound(w)
+		return
+	}
+
+	code, err := qr.Encode(totp.URI(twoFactorIssuer, app.authenticatedUser(r).Email, secret), qr.M)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	code.Scale = 5
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(code.PNG())
+}
+
+// enableTwoFactor turns on two-factor authentication once the user has shown
+// that their app has the secret by entering a code from it. Their recovery
+// codes are shown straight away rather than after a redirect, so that they
+// never have to be stored anywhere but as hashes.
+func (app *application) enableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	secret := app.session.GetString(r, "twoFactorSetup")
+	if secret == "" {
+		http.Redirect(w, r, "/user/2fa", http.StatusSeeOther)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("code")
+	step, ok := totp.Validate(secret, form.Get("code"), time.Now())
+	if form.Get("code") != "" && !ok {
+		form.Errors.Add("code", "This code is incorrect. Check that your device's clock is right")
+	}
+	if !form.Valid() {
+		app.renderTwoFactor(w, r, form, nil)
+		return
+	}
+
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	err = app.twoFactor.Enable(app.session.GetInt(r, "authenticatedUserID"), secret, step, codes)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.session.Remove(r, "twoFactorSetup")
+
+	app.renderTwoFactor(w, r, forms.New(nil), codes)
+}
+
+// confirmPassword checks the current password given in a form, adding an
+// error to the form if it's wrong. It returns false, having sent a response,
+// if something else went wrong.
+func (app *application) confirmPassword(w http.ResponseWriter, r *http.Request, form *forms.Form) bool {
+	form.Required("password")
+	if form.Get("password") == "" {
+		return true
+	}
+
+	err := app.users.CheckPassword(app.session.GetInt(r, "authenticatedUserID"), form.Get("password"))
+	if err == models.ErrInvalidCredentials {
+		form.Errors.Add("password", "Password is incorrect")
+	} else if err != nil {
+		app.serverError(w, err)
+		return false
+	}
+	return true
+}
+
+// disableTwoFactor turns off two-factor authentication. As this makes the
+// account easier to get into, it needs the current password.
+func (app *application) disableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	if !app.confirmPassword(w, r, form) {
+		return
+	}
+	if !form.Valid() {
+		app.renderTwoFactor(w, r, form, nil)
+		return
+	}
+
+	err = app.twoFactor.Disable(app.session.GetInt(r, "authenticatedUserID"))
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.session.Put(r, "flash", "Two-factor authentication is now off.")
+	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+}
+
+// regenerateRecoveryCodes replaces a user's recovery codes with new ones,
+// which also needs the current password.
+func (app *application) regenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	if !app.confirmPassword(w, r, form) {
+		return
+	}
+	if !form.Valid() {
+		app.renderTwoFactor(w, r, form, nil)
+		return
+	}
+
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	err = app.twoFactor.ReplaceRecoveryCodes(app.session.GetInt(r, "authenticatedUserID"), codes)
+	if err == models.ErrNoRecord {
+		http.Redirect(w, r, "/user/2fa", http.StatusSeeOther)
+		return
+	} else if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.renderTwoFactor(w, r, forms.New(nil), codes)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cb.net/snippetbox/pkg/models"
+)
+
+// sessionTouchInterval is how often a session's last seen time is updated.
+// Recording every request would mean a database write for each one.
+const sessionTouchInterval = time.Minute
+
+// startSession records a new server-side session for a user who has just
+// logged in, and keeps its token in the session cookie.
+func (app *application) startSession(r *http.Request, userID int) error {
+	token, err := app.userSessions.Insert(userID, remoteIP(r), r.UserAgent(), app.session.Lifetime)
+	if err != nil {
+		return err
+	}
+	app.session.Put(r, "sessionToken", token)
+	return nil
+}
+
+// endSession logs out the current request's session cookie.
+func (app *application) endSession(r *http.Request) {
+	app.session.Remove(r, "authenticatedUserID")
+	app.session.Remove(r, "sessionToken")
+}
+
+// currentSession returns the server-side record of the session the request
+// was authenticated with, or nil if there isn't one.
+func (app *application) currentSession(r *http.Request) *models.Session {
+	s, ok := r.Context().Value(contextKeySession).(*models.Session)
+	if !ok {
+		return nil
+	}
+	return s
+}
+
+// describeUserAgent turns a User-Agent header into something like "Firefox
+// on Windows", which is enough for most people to recognise their devices.
+func describeUserAgent(ua string) string {
+	var browser string
+	switch {
+	case strings.Contains(ua, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(ua, "OPR/"):
+		browser = "Opera"
+	case strings.Contains(ua, "Firefox/"):
+		browser = "Firefox"
+	case strings.Contains(ua, "Chrome/"), strings.Contains(ua, "CriOS/"):
+		browser = "Chrome"
+	case strings.Contains(ua, "Safari/"):
+		browser = "Safari"
+	}
+
+	var platform string
+	switch {
+	case strings.Contains(ua, "Windows"):
+		platform = "Windows"
+	case strings.Contains(ua, "iPhone"), strings.Contains(ua, "iPad"):
+		platform = "iOS"
+	case strings.Contains(ua, "Android"):
+		platform = "Android"
+	case strings.Contains(ua, "Mac OS X"):
+		platform = "macOS"
+	case strings.Contains(ua, "CrOS"):
+		platform = "ChromeOS"
+	case strings.Contains(ua, "Linux"):
+		platform = "Linux"
+	}
+
+	switch {
+	case browser != "" && platform != "":
+		return browser + " on " + platform
+	case browser != "":
+		return browser
+	case platform != "":
+		return "Browser on " + platform
+	}
+	return "Unknown device"
+}
+
+// revokeSession signs out one of the user's sessions. Signing out the
+// current session is the same as logging out.
+func (app *application) revokeSession(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get(":id"))
+	if err != nil || id < 1 {
+		app.notFound(w)
+		return
+	}
+
+	userID := app.session.GetInt(r, "authenticatedUserID")
+	err = app.userSessions.Revoke(id, userID)
+	if err == models.ErrNoRecord {
+		app.notFound(w)
+		return
+	} else if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	if s := app.currentSession(r); s != nil && s.ID == id {
+		app.endSession(r)
+		app.session.Put(r, "flash", "You've been logged out successfully!")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	app.session.Put(r, "flash", "Session signed out.")
+	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+}
+
+// revokeOtherSessions signs out all of the user's sessions except the
+// current one.
+func (app *application) revokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	s := app.currentSession(r)
+	if s == nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	err := app.userSessions.RevokeOthers(s.UserID, s.ID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.session.Put(r, "flash", "All your other sessions have been signed out.")
+	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"cb.net/snippetbox/pkg/forms"
+	"cb.net/snippetbox/pkg/models"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// verifyAudience marks email verification tokens, so that they can never be
+// mistaken for tokens issued for any other purpose.
+const verifyAudience = "quotebox-verify"
+
+// verifyClaims are the claims of an email verification token. The token is
+// only good for the address it was sent to, so changing a user's email
+// address makes any earlier links useless.
+type verifyClaims struct {
+	Email string `json:"email"`
+	jwt.StandardClaims
+}
+
+// verifyKey derives the key used to sign email verification tokens from the
+// application secret, in the same way as jwtKey but with a different label,
+// so that neither kind of token can be passed off as the other.
+func verifyKey(secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("email verification signing key"))
+	return mac.Sum(nil)
+}
+
+// verificationToken returns a signed token which verifies the user's address
+// when they follow the link it is sent in. Nothing is stored, so a token
+// stays good until it expires or the address is verified.
+func (app *application) verificationToken(id int, email string) (string, error) {
+	now := time.Now()
+	claims := &verifyClaims{
+		Email: email,
+		StandardClaims: jwt.StandardClaims{
+			Audience:  verifyAudience,
+			ExpiresAt: now.Add(app.verifyLifetime).Unix(),
+			IssuedAt:  now.Unix(),
+			Issuer:    jwtIssuer,
+			Subject:   strconv.Itoa(id),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(app.verifyKey)
+}
+
+// sendVerification emails a user a link for verifying their address.
+func (app *application) sendVerification(u *models.User) error {
+	token, err := app.verificationToken(u.ID, u.Email)
+	if err != nil {
+		return err
+	}
+
+	link := app.emailLink("/user/verify", url.Values{"token": {token}})
+	body := fmt.Sprintf("Hello %s,\n\nThanks for signing up to Quotebox. "+
+		"To verify your email address and activate your account, follow this link before %s UTC:\n\n%s\n\n"+
+		"If you didn't sign up, you can ignore this email.\n",
+		u.Name, humanDate(time.Now().UTC().Add(app.verifyLifetime)), link)
+	app.sendEmail(u.Email, "Verify your Quotebox email address", body)
+	return nil
+}
+
+// verifyUser marks the address of the account named by the token in a
+// verification link as verified.
+func (app *application) verifyUser(w http.ResponseWriter, r *http.Request) {
+	claims := &verifyClaims{}
+	_, err := jwt.ParseWithClaims(r.URL.Query().Get("token"), claims, func(t *jwt.Token) (interface{}, error) {
+		if t.Method != jwt.SigningMethodHS256 {
+			return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+		}
+		return app.verifyKey, nil
+	})
+	id, _ := strconv.Atoi(claims.Subject)
+	if err != nil || !claims.VerifyAudience(verifyAudience, true) || id < 1 {
+		app.session.Put(r, "flash", "This verification link is invalid or has expired. Log in to have a new one sent.")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	err = app.users.VerifyEmail(id, claims.Email)
+	if err == models.ErrNoRecord {
+		app.session.Put(r, "flash", "This verification link has already been used. Please log in.")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	} else if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.session.Put(r, "flash", "Your email address is verified. Please log in.")
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// resendVerification sends a new verification link to an address which
+// belongs to an active account that hasn't been verified yet. The response is the
+// same whether or not it does, and each address can only be sent one link a
+// minute, however many clients ask.
+func (app *application) resendVerification(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("email")
+	form.MatchesPattern("email", forms.EmailRX)
+	if !form.Valid() {
+		app.render(w, r, "login.page.tmpl", &templateData{Form: form})
+		return
+	}
+
+	if ok, _ := app.verifyLimiter.allow("verify:" + strings.ToLower(form.Get("email"))); ok {
+		u, err := app.users.GetByEmail(form.Get("email"))
+		if err != nil && err != models.ErrNoRecord {
+			app.serverError(w, err)
+			return
+		}
+		if u != nil && u.Active && !u.EmailVerified {
+			if err = app.sendVerification(u); err != nil {
+				app.serverError(w, err)
+				return
+			}
+		}
+	}
+
+	app.session.Put(r, "flash", "If that address belongs to an account awaiting verification, we've sent it a new link.")
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"cb.net/snippetbox/pkg/models"
+)
+
+// dispatcher delivers webhook payloads in the background. Events are
+// written to the delivery log in the database as they happen, and a worker
+// sends whatever is due, retrying failed deliveries with exponential backoff.
+// Because the log is the queue, deliveries survive a restart.
+type dispatcher struct {
+	webhooks interface {
+		Subscribers(string, int, bool, bool) ([]*models.Webhook, error)
+		Enqueue(int, string, string) (int, error)
+		Due(time.Time, int, time.Duration) ([]*models.Delivery, error)
+		Record(int, int, string, bool, time.Time) error
+	}
+	client   *http.Client
+	errorLog *log.Logger
+	infoLog  *log.Logger
+
+	// interval is how often the worker checks for due deliveries when it
+	// hasn't been woken by a new event. A delivery which fails is retried
+	// after backoff, doubling after each further failure, until it has been
+	// attempted maxAttempts times.
+	interval    time.Duration
+	backoff     time.Duration
+	maxAttempts int
+
+	// now returns the current time. It is a field so that the clock can be
+	// replaced when testing.
+	now func() time.Time
+
+	wake chan struct{}
+	quit chan struct{}
+	done chan struct{}
+}
+
+// webhookPayload is the JSON body sent to webhooks. Snippet is set for
+// snippet events and User for user events; Actor is the user who caused the
+// event.
+type webhookPayload struct {
+	Event   string       `json:"event"`
+	Created time.Time    `json:"created"`
+	Actor   *webhookUser `json:"actor,omitempty"`
+	Snippet *apiSnippet  `json:"snippet,omitempty"`
+	User    *webhookUser `json:"user,omitempty"`
+}
+
+type webhookUser struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// start runs the delivery worker in a new goroutine until stop is called.
+func (d *dispatcher) start() {
+	d.wake = make(chan struct{}, 1)
+	d.quit = make(chan struct{})
+	d.done = make(chan struct{})
+	go d.run()
+}
+
+// stop signals the worker to finish and waits for the delivery in progress,
+// if any, to complete. Deliveries still pending are sent after the next
+// start.
+func (d *dispatcher) stop() {
+	close(d.quit)
+	<-d.done
+}
+
+func (d *dispatcher) run() {
+	defer close(d.done)
+
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		d.deliverDue()
+		select {
+		case <-ticker.C:
+		case <-d.wake:
+		case <-d.quit:
+			return
+		}
+	}
+}
+
+// notify queues deliveries of an event to the webhooks which should hear
+// about it (see WebhookModel.Subscribers) and wakes the worker. Errors are
+// logged rather than returned, so that a webhook problem never fails the
+// request which caused the event.
+func (d *dispatcher) notify(p *webhookPayload, ownerID int, public, admins bool) {
+	hooks, err := d.webhooks.Subscribers(p.Event, ownerID, public, admins)
+	if err != nil {
+		d.errorLog.Print(err)
+		return
+	}
+	if len(hooks) == 0 {
+		return
+	}
+
+	p.Created = d.now().UTC()
+	body, err := json.Marshal(p)
+	if err != nil {
+		d.errorLog.Print(err)
+		return
+	}
+	for _, h := range hooks {
+		if _, err := d.webhooks.Enqueue(h.ID, p.Event, string(body)); err != nil {
+			d.errorLog.Print(err)
+		}
+	}
+
+	d.poke()
+}
+
+// poke wakes the worker to send any deliveries that are now due, without
+// waiting for the next tick.
+func (d *dispatcher) poke() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliverDue sends every delivery that is due, a batch at a time, until
+// there are none left or the worker is told to stop.
+func (d *dispatcher) deliverDue() {
+	const batchSize = 20
+	for {
+		// Each claimed delivery is leased for long enough to send the whole
+		// batch, even if every request times out.
+		lease := time.Duration(batchSize+1) * d.client.Timeout
+		due, err := d.webhooks.Due(d.now().UTC(), batchSize, lease)
+		if err != nil {
+			d.errorLog.Print(err)
+			return
+		}
+		for _, dl := range due {
+			d.deliver(dl)
+			if d.stopping() {
+				return
+			}
+		}
+		if len(due) < batchSize {
+			return
+		}
+	}
+}
+
+// deliver makes one attempt to send a delivery and records the outcome. Any
+// 2xx response counts as success.
+func (d *dispatcher) deliver(dl *models.Delivery) {
+	code, err := d.send(dl)
+	attempts := dl.Attempts + 1
+
+	var next time.Time
+	if err != nil && attempts < d.maxAttempts {
+		next = d.now().UTC().Add(d.backoff << uint(attempts-1))
+	}
+	errMsg := ""
+	if err != nil {
+		errMsg = err.Error()
+	}
+
+	err = d.webhooks.Record(dl.ID, code, errMsg, errMsg == "", next)
+	if err != nil {
+		d.errorLog.Print(err)
+	}
+}
+
+// send POSTs the delivery's payload to its webhook, signed with the
+// webhook's secret, and returns the response status code. The signature is
+// the hex-encoded HMAC-SHA256 of the body, sent in the X-Quotebox-Signature
+// header as "sha256=<signature>".
+func (d *dispatcher) send(dl *models.Delivery) (int, error) {
+	body := []byte(dl.Payload)
+	req, err := http.NewRequest("POST", dl.Webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Quotebox-Webhook/1.0")
+	req.Header.Set("X-Quotebox-Event", dl.Event)
+	req.Header.Set("X-Quotebox-Delivery", strconv.Itoa(dl.ID))
+	req.Header.Set("X-Quotebox-Signature", "sha256="+signPayload(dl.Webhook.Secret, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected response %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// blockedNetworks are the address ranges webhooks are never delivered to:
+// loopback, private and link-local addresses, which include cloud metadata
+// services, and other special-purpose ranges. Otherwise anyone could add a
+// webhook which had the server make requests to the machines behind it.
+// NAT64 and 6to4 addresses are blocked outright, as they embed IPv4
+// addresses which a gateway on the way may translate them back to.
+var blockedNetworks = parseCIDRs(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15",
+	"224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "64:ff9b::/96", "64:ff9b:1::/48", "2002::/16",
+	"fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+// blockedIP reports whether ip is in one of the blockedNetworks. IPv4
+// addresses written as IPv6 are checked as IPv4.
+func blockedIP(ip net.IP) bool {
+	for _, n := range blockedNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// blockedHost reports whether a webhook URL's host is plainly one that
+// deliveries would be refused for, so that the webhook can be turned away
+// when it is added. Names which resolve to blocked addresses are caught
+// when deliveries are made instead; see checkWebhookAddress.
+func blockedHost(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && blockedIP(ip)
+}
+
+// checkWebhookAddress is the net.Dialer Control function for webhook
+// deliveries. It sees the address actually being connected to, after DNS
+// resolution, so it also stops names which resolve to blocked addresses,
+// including ones which change between checks, and redirects to them.
+func checkWebhookAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("webhook address %s is not an IP address", host)
+	}
+	if blockedIP(ip) {
+		return fmt.Errorf("webhook address %s is not allowed", ip)
+	}
+	return nil
+}
+
+// newWebhookClient returns the HTTP client deliveries are made with, which
+// refuses to connect to blocked addresses. It never uses a proxy, as the
+// check would then apply to the proxy rather than the webhook.
+func newWebhookClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+		Control:   checkWebhookAddress,
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+			MaxIdleConns:        10,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+}
+
+// signPayload returns the hex-encoded HMAC-SHA256 of body keyed by secret.
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// stopping reports whether stop has been called.
+func (d *dispatcher) stopping() bool {
+	select {
+	case <-d.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// snippetEvent notifies webhooks of an event on a snippet made by the
+// current user. Everyone's webhooks hear about public snippets, but only
+// the owner's hear about unlisted and private ones. New public snippets are
+// also pushed to the home pages open in browsers.
+func (app *application) snippetEvent(r *http.Request, event string, s *models.Snippet) {
+	if event == models.EventSnippetCreated && s.Visibility == models.VisibilityPublic {
+		app.publishSnippet(s)
+	}
+	app.dispatcher.notify(&webhookPayload{
+		Event:   event,
+		Actor:   actor(app.authenticatedUser(r)),
+		Snippet: newAPISnippet(s),
+	}, s.UserID, s.Visibility == models.VisibilityPublic, false)
+}
+
+// snippetEventByID fetches a snippet which has just been created or updated
+// and notifies webhooks of the event.
+func (app *application) snippetEventByID(r *http.Request, event string, id int) {
+	s, err := app.snippets.Get(id)
+	if err != nil {
+		app.errorLog.Print(err)
+		return
+	}
+	app.snippetEvent(r, event, s)
+}
+
+func actor(u *models.User) *webhookUser {
+	if u == nil {
+		return nil
+	}
+	return &webhookUser{ID: u.ID, Name: u.Name}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cb.net/snippetbox/pkg/models"
+)
+
+// fakeWebhookStore is an in-memory delivery log which behaves like
+// WebhookModel's.
+type fakeWebhookStore struct {
+	mu         sync.Mutex
+	hook       *models.Webhook
+	deliveries []*models.Delivery
+}
+
+func (s *fakeWebhookStore) Subscribers(event string, ownerID int, public, admins bool) ([]*models.Webhook, error) {
+	return []*models.Webhook{s.hook}, nil
+}
+
+func (s *fakeWebhookStore) Enqueue(webhookID int, event, payload string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := &models.Delivery{
+		ID:        len(s.deliveries) + 1,
+		WebhookID: webhookID,
+		Event:     event,
+		Payload:   payload,
+		Status:    models.DeliveryPending,
+	}
+	s.deliveries = append(s.deliveries, d)
+	return d.ID, nil
+}
+
+func (s *fakeWebhookStore) Due(now time.Time, limit int, lease time.Duration) ([]*models.Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var due []*models.Delivery
+	for _, d := range s.deliveries {
+		if len(due) < limit && d.Status == models.DeliveryPending && !d.NextAttempt.After(now) {
+			d.NextAttempt = now.Add(lease)
+			c := *d
+			c.Webhook = s.hook
+			due = append(due, &c)
+		}
+	}
+	return due, nil
+}
+
+func (s *fakeWebhookStore) Record(id, code int, errMsg string, delivered bool, next time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := s.deliveries[id-1]
+	d.Attempts++
+	d.ResponseCode = code
+	d.Error = errMsg
+	d.NextAttempt = next
+	switch {
+	case delivered:
+		d.Status = models.DeliveryDelivered
+	case next.IsZero():
+		d.Status = models.DeliveryFailed
+	default:
+		d.Status = models.DeliveryPending
+	}
+	return nil
+}
+
+// redeliver does what WebhookModel.Redeliver does.
+func (s *fakeWebhookStore) redeliver(id int, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := s.deliveries[id-1]
+	d.Status = models.DeliveryPending
+	d.Attempts = 0
+	d.NextAttempt = now
+}
+
+func (s *fakeWebhookStore) delivery(id int) models.Delivery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return *s.deliveries[id-1]
+}
+
+// receiver is an httptest webhook endpoint which records the requests it
+// gets and answers them with status.
+type receiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	status   int
+	requests []*http.Request
+	bodies   []string
+	got      chan struct{}
+}
+
+func newReceiver(t *testing.T) *receiver {
+	rc := &receiver{status: http.StatusOK, got: make(chan struct{}, 10)}
+	rc.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		rc.mu.Lock()
+		rc.requests = append(rc.requests, r)
+		rc.bodies = append(rc.bodies, string(body))
+		status := rc.status
+		rc.mu.Unlock()
+		w.WriteHeader(status)
+		rc.got <- struct{}{}
+	}))
+	return rc
+}
+
+func (rc *receiver) setStatus(status int) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.status = status
+}
+
+func newTestDispatcher(t *testing.T, rc *receiver) (*dispatcher, *fakeWebhookStore, *fakeClock) {
+	store := &fakeWebhookStore{hook: &models.Webhook{ID: 1, UserID: 7, URL: rc.URL + "/hook", Secret: "0123456789abcdef"}}
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	discard := log.New(ioutil.Discard, "", 0)
+	// The receiver is on the loopback address, which the real client
+	// refuses to deliver to, so the tests use the receiver's own client.
+	client := rc.Client()
+	client.Timeout = 5 * time.Second
+	d := &dispatcher{
+		webhooks:    store,
+		client:      client,
+		errorLog:    discard,
+		infoLog:     discard,
+		interval:    time.Hour,
+		backoff:     30 * time.Second,
+		maxAttempts: 3,
+		now:         clock.now,
+	}
+	return d, store, clock
+}
+
+func TestDispatcherSignsDeliveries(t *testing.T) {
+	rc := newReceiver(t)
+	defer rc.Close()
+	d, store, _ := newTestDispatcher(t, rc)
+	d.start()
+	defer d.stop()
+
+	d.notify(&webhookPayload{Event: models.EventSnippetCreated, Snippet: &apiSnippet{ID: 42, Title: "Hello"}}, 7, true, false)
+	select {
+	case <-rc.got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no delivery received")
+	}
+
+	rc.mu.Lock()
+	r, body := rc.requests[0], rc.bodies[0]
+	rc.mu.Unlock()
+
+	mac := hmac.New(sha256.New, []byte("0123456789abcdef"))
+	mac.Write([]byte(body))
+	headers := map[string]string{
+		"Content-Type":         "application/json",
+		"X-Quotebox-Event":     models.EventSnippetCreated,
+		"X-Quotebox-Delivery":  "1",
+		"X-Quotebox-Signature": "sha256=" + hex.EncodeToString(mac.Sum(nil)),
+	}
+	for name, want := range headers {
+		if got := r.Header.Get(name); got != want {
+			t.Errorf("want %s %q; got %q", name, want, got)
+		}
+	}
+	if r.URL.Path != "/hook" || !strings.Contains(body, `"title":"Hello"`) {
+		t.Errorf("unexpected delivery to %s: %s", r.URL.Path, body)
+	}
+
+	// The outcome is recorded after the response has been read, so give
+	// the worker a moment to get there.
+	deadline := time.Now().Add(5 * time.Second)
+	for store.delivery(1).Status != models.DeliveryDelivered && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if dl := store.delivery(1); dl.Status != models.DeliveryDelivered || dl.ResponseCode != http.StatusOK {
+		t.Errorf("want delivered with 200; got %s with %d", dl.Status, dl.ResponseCode)
+	}
+}
+
+func TestDispatcherRetries(t *testing.T) {
+	rc := newReceiver(t)
+	defer rc.Close()
+	rc.setStatus(http.StatusInternalServerError)
+	d, store, clock := newTestDispatcher(t, rc)
+	store.Enqueue(1, models.EventSnippetCreated, `{}`)
+
+	// Each failure pushes the next attempt back by double the last delay,
+	// until the attempts run out.
+	steps := []struct {
+		wait       time.Duration
+		wantStatus string
+		wantNext   time.Duration
+	}{
+		{0, models.DeliveryPending, 30 * time.Second},
+		{30 * time.Second, models.DeliveryPending, 60 * time.Second},
+		{60 * time.Second, models.DeliveryFailed, 0},
+	}
+	for i, st := range steps {
+		clock.advance(st.wait)
+		d.deliverDue()
+
+		dl := store.delivery(1)
+		var wantNext time.Time
+		if st.wantNext > 0 {
+			wantNext = clock.now().Add(st.wantNext)
+		}
+		if dl.Attempts != i+1 || dl.Status != st.wantStatus || !dl.NextAttempt.Equal(wantNext) {
+			t.Errorf("attempt %d: want %s next at %v; got %d attempts, %s next at %v",
+				i+1, st.wantStatus, wantNext, dl.Attempts, dl.Status, dl.NextAttempt)
+		}
+		if dl.ResponseCode != http.StatusInternalServerError || dl.Error == "" {
+			t.Errorf("attempt %d: want the 500 response recorded; got %d %q", i+1, dl.ResponseCode, dl.Error)
+		}
+
+		// Nothing more is sent before the next attempt is due.
+		d.deliverDue()
+		if n := store.delivery(1).Attempts; n != i+1 {
+			t.Fatalf("attempt %d: want %d attempts before the backoff; got %d", i+1, i+1, n)
+		}
+	}
+
+	// A redelivery starts again with a fresh set of attempts.
+	rc.setStatus(http.StatusNoContent)
+	store.redeliver(1, clock.now())
+	d.deliverDue()
+	if dl := store.delivery(1); dl.Status != models.DeliveryDelivered || dl.Attempts != 1 || dl.ResponseCode != http.StatusNoContent {
+		t.Errorf("redelivery: want delivered after 1 attempt with 204; got %s after %d with %d", dl.Status, dl.Attempts, dl.ResponseCode)
+	}
+
+	rc.mu.Lock()
+	n := len(rc.requests)
+	rc.mu.Unlock()
+	if n != 4 {
+		t.Errorf("want 4 requests received; got %d", n)
+	}
+}
+
+func TestBlockedHost(t *testing.T) {
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"example.com", false},
+		{"93.184.216.34", false},
+		{"2606:2800:220:1::", false},
+		{"localhost", true},
+		{"LOCALHOST.", true},
+		{"api.localhost", true},
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"100.64.0.1", true},
+		{"0.0.0.0", true},
+		{"::1", true},
+		{"fd00::1", true},
+		{"fe80::1", true},
+		{"::ffff:127.0.0.1", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			if got := blockedHost(tt.host); got != tt.want {
+				t.Errorf("want %v; got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestBlockedIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", false},
+		{"2606:2800:220:1::", false},
+		{"10.0.0.1", true},
+		{"::ffff:10.0.0.1", true},
+		// NAT64, mapping to 10.0.0.1.
+		{"64:ff9b::a00:1", true},
+		{"64:ff9b:1::a00:1", true},
+		// 6to4, tunnelled through 10.0.0.1.
+		{"2002:a00:1::1", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := blockedIP(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("want %v; got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCheckWebhookAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		wantErr bool
+	}{
+		{"93.184.216.34:443", false},
+		{"[2606:2800:220:1::]:443", false},
+		{"127.0.0.1:80", true},
+		{"169.254.169.254:80", true},
+		{"[::1]:443", true},
+		{"[::ffff:10.0.0.1]:443", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			err := checkWebhookAddress("tcp", tt.address, nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("want error %v; got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestWebhookClientRefusesInternalAddresses(t *testing.T) {
+	hit := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hit = true
+	}))
+	defer ts.Close()
+
+	// Reach the loopback server both directly and through a name, as a
+	// webhook pointing at a name which resolves to it would.
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+	for _, u := range []string{ts.URL, "http://localhost:" + port} {
+		resp, err := newWebhookClient(5*time.Second).Post(u, "application/json", strings.NewReader("{}"))
+		if err == nil {
+			resp.Body.Close()
+			t.Errorf("%s: want the delivery refused; got %s", u, resp.Status)
+		} else if !strings.Contains(err.Error(), "not allowed") {
+			t.Errorf("%s: want a not allowed error; got %v", u, err)
+		}
+	}
+	if hit {
+		t.Error("the internal server was reached")
+	}
+}
+
+func TestWebhookClientRefusesRedirectsToInternalAddresses(t *testing.T) {
+	// The only way to stand up a "public" server in a test is on the
+	// loopback address too, so this checks the redirect is followed
+	// through the same dialer by looking at where the error came from.
+	ts := httptest.NewServer(http.RedirectHandler("http://169.254.169.254/latest/meta-data/", http.StatusFound))
+	defer ts.Close()
+
+	client := newWebhookClient(5 * time.Second)
+	transport := client.Transport.(*http.Transport)
+	dial := transport.DialContext
+	dialed := []string{}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		if addr == ts.Listener.Addr().String() {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		}
+		return dial(ctx, network, addr)
+	}
+
+	_, err := client.Post(ts.URL, "application/json", strings.NewReader("{}"))
+	if err == nil || !strings.Contains(err.Error(), "169.254.169.254 is not allowed") {
+		t.Errorf("want the redirect refused; got %v", err)
+	}
+	if len(dialed) != 2 || dialed[1] != "169.254.169.254:80" {
+		t.Errorf("want the redirect target dialed through the check; got %v", dialed)
+	}
+}
@@ -1,13 +1,14 @@
 module cb.net/snippetbox
 
-go 1.12
+go 1.20
 
 require (
 	github.com/bmizerany/pat v0.0.0-20170815010413-6226ea591a40
-	github.com/dgrijalva/jwt-go v3.2.0+incompatible // indirect
+	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/go-sql-driver/mysql v1.4.1
 	github.com/golangcollege/sessions v1.1.0
 	github.com/justinas/alice v0.0.0-20171023064455-03f45bd4b7da
 	github.com/justinas/nosurf v0.0.0-20190416172904-05988550ea18
 	golang.org/x/crypto v0.0.0-20181009213950-7c1a557ab941
+	rsc.io/qr v0.2.0
 )
@@ -0,0 +1,110 @@
+// Package diff computes the differences between two versions of a piece of
+// text, either word by word or line by line.
+package diff
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Kind says whether a piece of text is common to both versions, or was only
+// present in the old or new one.
+type Kind int
+
+const (
+	Equal Kind = iota
+	Delete
+	Insert
+)
+
+// Op is a run of text with the same Kind.
+type Op struct {
+	Kind Kind
+	Text string
+}
+
+// Equal, Delete and Insert report the kind of the op, for use in templates.
+func (o Op) Equal() bool  { return o.Kind == Equal }
+func (o Op) Delete() bool { return o.Kind == Delete }
+func (o Op) Insert() bool { return o.Kind == Insert }
+
+// wordRX splits text into alternating runs of whitespace and non-whitespace
+// so that the original spacing survives the diff.
+var wordRX = regexp.MustCompile(`\s+|\S+`)
+
+// Words returns the ops that turn a into b, comparing word by word.
+func Words(a, b string) []Op {
+	return diff(wordRX.FindAllString(a, -1), wordRX.FindAllString(b, -1))
+}
+
+// Lines returns the ops that turn a into b, comparing line by line.
+func Lines(a, b string) []Op {
+	return diff(splitLines(a), splitLines(b))
+}
+
+// splitLines splits text after each newline, keeping the newlines.
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diff computes a longest common subsequence of the two token lists and
+// walks it to produce the ops, merging adjacent tokens of the same kind.
+// Quotes are short, so the quadratic table is not a concern.
+func diff(a, b []string) []Op {
+	// lcs[i][j] holds the length of the longest common subsequence of a[i:]
+	// and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var ops []Op
+	add := func(kind Kind, text string) {
+		if n := len(ops); n > 0 && ops[n-1].Kind == kind {
+			ops[n-1].Text += text
+			return
+		}
+		ops = append(ops, Op{Kind: kind, Text: text})
+	}
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			add(Equal, a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			add(Delete, a[i])
+			i++
+		default:
+			add(Insert, b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		add(Delete, a[i])
+	}
+	for ; j < len(b); j++ {
+		add(Insert, b[j])
+	}
+	return ops
+}
@@ -0,0 +1,64 @@
+package diff
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWords(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want []Op
+	}{
+		{"Both empty", "", "", nil},
+		{"Identical", "a b", "a b", []Op{{Equal, "a b"}}},
+		{"From empty", "", "new words", []Op{{Insert, "new words"}}},
+		{"To empty", "old words", "", []Op{{Delete, "old words"}}},
+		{"Replaced word", "the cat sat", "the dog sat", []Op{
+			{Equal, "the "}, {Delete, "cat"}, {Insert, "dog"}, {Equal, " sat"},
+		}},
+		{"Added words", "to be", "to be or not to be", []Op{
+			{Equal, "to be"}, {Insert, " or not to be"},
+		}},
+		{"Changed spacing", "a  b", "a b", []Op{
+			{Equal, "a"}, {Delete, "  "}, {Insert, " "}, {Equal, "b"},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Words(tt.a, tt.b)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("want %v; got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestLines(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want []Op
+	}{
+		{"Both empty", "", "", nil},
+		{"Identical", "one\ntwo\n", "one\ntwo\n", []Op{{Equal, "one\ntwo\n"}}},
+		{"Replaced line", "one\ntwo\nthree\n", "one\n2\nthree\n", []Op{
+			{Equal, "one\n"}, {Delete, "two\n"}, {Insert, "2\n"}, {Equal, "three\n"},
+		}},
+		{"Removed lines", "x\ny\n", "", []Op{{Delete, "x\ny\n"}}},
+		{"No final newline", "a\nb", "a\nb\nc", []Op{
+			{Equal, "a\n"}, {Delete, "b"}, {Insert, "b\nc"},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Lines(tt.a, tt.b)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("want %v; got %v", tt.want, got)
+			}
+		})
+	}
+}
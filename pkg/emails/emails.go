@@ -26,7 +26,7 @@ func (e *Email) Send() {
 
 	msg := "From: " + e.from + "\n" +
 		"To: " + e.to + "\n" +
-		"Subject: Hello there\n\n" +
+		"Subject: " + e.subject + "\n\n" +
 		e.content
 
 	err := smtp.SendMail("smtp.gmail.com:587",
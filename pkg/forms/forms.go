@@ -3,6 +3,7 @@ package forms
 import (
 	"fmt"
 	"net/url"
+	"strconv"
 	"strings"
 	"regexp"
 	"unicode/utf8"
@@ -16,6 +17,25 @@ import (
 // every request.
 var EmailRX = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+\\/'=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
 
+// TagRX matches a single tag: lowercase letters, digits and inner hyphens.
+var TagRX = regexp.MustCompile("^[a-z0-9]+(?:-[a-z0-9]+)*$")
+
+// SplitTags breaks a comma-separated list of tags into its lowercased,
+// trimmed and de-duplicated parts, dropping any empty entries.
+func SplitTags(value string) []string {
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, tag := range strings.Split(value, ",") {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
 // Create a custom Form struct, which anonymously embeds a url.Values object
 // (to hold the form data) and an Errors field to hold any validation errors
 // for the form data.
@@ -75,6 +95,52 @@ func (f *Form) PermittedValues(field string, opts ...string) {
 	f.Errors.Add(field, "This field is invalid")
 }
 
+// Implement a Subset method to check that every value of a multi-valued
+// field in the form, such as a group of checkboxes, is one of a set of
+// permitted values. If the check fails then add the appropriate message to
+// the form errors.
+func (f *Form) Subset(field string, opts ...string) {
+	for _, value := range f.Values[field] {
+		ok := false
+		for _, opt := range opts {
+			if value == opt {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			f.Errors.Add(field, "This field is invalid")
+			return
+		}
+	}
+}
+
+// Implement a Contains method to report whether a multi-valued field in the
+// form includes a specific value. This is used to re-check checkboxes when a
+// form is redisplayed.
+func (f *Form) Contains(field, value string) bool {
+	for _, v := range f.Values[field] {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Implement a URL method to check that a specific field in the form holds an
+// absolute http or https URL. If the check fails then add the appropriate
+// message to the form errors.
+func (f *Form) URL(field string) {
+	value := f.Get(field)
+	if value == "" {
+		return
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		f.Errors.Add(field, "This field must be an http or https URL")
+	}
+}
+
 // Implement a MinLength method to check that a specific field in the form
 // contains a minimum number of characters. If the check fails then add the
 // appropriate message to the form errors.
@@ -100,6 +166,54 @@ func (f *Form) MatchesPattern(field string, pattern *regexp.Regexp) {
 		f.Errors.Add(field, "This field is invalid")
 	}
 }
+
+// Implement a Tags method to check that a specific field in the form holds a
+// comma-separated list of at most max tags, each matching TagRX and no longer
+// than maxLength characters. If the check fails then add the appropriate
+// message to the form errors.
+func (f *Form) Tags(field string, max, maxLength int) {
+	tags := SplitTags(f.Get(field))
+	if len(tags) > max {
+		f.Errors.Add(field, fmt.Sprintf("This field has too many tags (maximum is %d)", max))
+		return
+	}
+	for _, tag := range tags {
+		if utf8.RuneCountInString(tag) > maxLength {
+			f.Errors.Add(field, fmt.Sprintf("Tag %q is too long (maximum is %d characters)", tag, maxLength))
+			return
+		}
+		if !TagRX.MatchString(tag) {
+			f.Errors.Add(field, fmt.Sprintf("Tag %q may only contain letters, numbers and hyphens", tag))
+			return
+		}
+	}
+}
+
+// Implement an IntegerRange method to check that a specific field in the form
+// holds a whole number between min and max inclusive. If the check fails then
+// add the appropriate message to the form errors.
+func (f *Form) IntegerRange(field string, min, max int) {
+	value := strings.TrimSpace(f.Get(field))
+	if value == "" {
+		return
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		f.Errors.Add(field, "This field must be a whole number")
+		return
+	}
+	if n < min || n > max {
+		f.Errors.Add(field, fmt.Sprintf("This field must be between %d and %d", min, max))
+	}
+}
+
+// Implement an Int method to return the whole number held in a specific
+// field, or zero if the field is blank or not a number.
+func (f *Form) Int(field string) int {
+	n, _ := strconv.Atoi(strings.TrimSpace(f.Get(field)))
+	return n
+}
+
 // Implement a Valid method which returns true if there are no errors.
 func (f *Form) Valid() bool {
 	return len(f.Errors) == 0
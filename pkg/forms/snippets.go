@@ -0,0 +1,105 @@
+package forms
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"cb.net/snippetbox/pkg/models"
+)
+
+// ExpiresLayout is the format of the expires_at field, as sent by a
+// datetime-local input. Times are taken to be UTC unless a tz_offset field
+// says otherwise; see customExpiry.
+const ExpiresLayout = "2006-01-02T15:04"
+
+// maxOffset is the largest offset from UTC of any time zone, in minutes.
+const maxOffset = 14 * 60
+
+// ValidateNewSnippet applies the validation rules for creating a snippet:
+// the shared content rules plus the choice of expiry time. Every way of
+// adding quotes (the create form, the API and imports) goes through here so
+// that they all enforce the same limits.
+func ValidateNewSnippet(f *Form) {
+	f.Required("expires")
+	f.PermittedValues("expires", "365", "7", "1", "custom", "never")
+	if f.Get("expires") == "custom" {
+		f.Required("expires_at")
+		f.IntegerRange("tz_offset", -maxOffset, maxOffset)
+		if f.Get("expires_at") != "" {
+			t, ok := customExpiry(f)
+			if !ok {
+				f.Errors.Add("expires_at", "This field is not a valid date and time")
+			} else if !t.After(time.Now()) {
+				f.Errors.Add("expires_at", "This field must be in the future")
+			}
+		}
+	}
+	ValidateSnippet(f)
+}
+
+// ValidateSnippet applies the validation rules shared by every form that
+// writes a snippet's content, attribution and tags.
+func ValidateSnippet(f *Form) {
+	thisYear := time.Now().Year()
+	f.Required("title", "content", "author")
+	f.MaxLength("title", 20)
+	f.MaxLength("content", 500)
+	f.MaxLength("author", 100)
+	f.IntegerRange("author_born", -5000, thisYear)
+	f.IntegerRange("author_died", -5000, thisYear)
+	f.MaxLength("author_bio", 1000)
+	f.MaxLength("source", 255)
+	f.IntegerRange("year", -5000, thisYear)
+	f.Tags("tags", 10, 30)
+	f.Required("visibility")
+	f.PermittedValues("visibility", models.VisibilityPublic, models.VisibilityUnlisted, models.VisibilityPrivate)
+}
+
+// Snippet builds a snippet from the fields of a validated snippet form. The
+// author is described by name, lifespan and bio but has no ID; it's up to
+// the caller to look them up or create them.
+func Snippet(f *Form) *models.Snippet {
+	return &models.Snippet{
+		Title:   f.Get("title"),
+		Content: f.Get("content"),
+		Author: &models.Author{
+			Name: strings.TrimSpace(f.Get("author")),
+			Born: f.Int("author_born"),
+			Died: f.Int("author_died"),
+			Bio:  f.Get("author_bio"),
+		},
+		Source:     strings.TrimSpace(f.Get("source")),
+		Year:       f.Int("year"),
+		Tags:       SplitTags(f.Get("tags")),
+		Visibility: f.Get("visibility"),
+	}
+}
+
+// ExpiryTime converts the expiry chosen on a validated create form into the
+// time the snippet should expire, or the zero time if it never expires.
+func ExpiryTime(f *Form) time.Time {
+	switch f.Get("expires") {
+	case "never":
+		return time.Time{}
+	case "custom":
+		t, _ := customExpiry(f)
+		return t
+	}
+	days, _ := strconv.Atoi(f.Get("expires"))
+	return time.Now().UTC().AddDate(0, 0, days)
+}
+
+// customExpiry returns the time in the expires_at field, in UTC. A
+// datetime-local input gives the time as the user's own clock shows it, so
+// the create form also sends the browser's offset from UTC at that time in
+// tz_offset, as minutes to add to get UTC, the same as JavaScript's
+// Date.getTimezoneOffset. The API and imports don't send one, so their times
+// are UTC already.
+func customExpiry(f *Form) (time.Time, bool) {
+	t, err := time.Parse(ExpiresLayout, strings.TrimSpace(f.Get("expires_at")))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t.Add(time.Duration(f.Int("tz_offset")) * time.Minute), true
+}
@@ -0,0 +1,73 @@
+package forms
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestExpiryTime(t *testing.T) {
+	tests := []struct {
+		name      string
+		expiresAt string
+		offset    string
+		want      time.Time
+	}{
+		{"No offset", "2030-06-01T12:00", "", time.Date(2030, 6, 1, 12, 0, 0, 0, time.UTC)},
+		{"West of UTC", "2030-06-01T12:00", "300", time.Date(2030, 6, 1, 17, 0, 0, 0, time.UTC)},
+		{"East of UTC", "2030-06-01T12:00", "-330", time.Date(2030, 6, 1, 6, 30, 0, 0, time.UTC)},
+		{"Invalid", "tomorrow", "", time.Time{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := New(url.Values{
+				"expires":    {"custom"},
+				"expires_at": {tt.expiresAt},
+				"tz_offset":  {tt.offset},
+			})
+			got := ExpiryTime(f)
+			if !got.Equal(tt.want) {
+				t.Errorf("want %v; got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestValidateCustomExpiry(t *testing.T) {
+	soon := time.Now().UTC().Add(2 * time.Hour).Format(ExpiresLayout)
+
+	tests := []struct {
+		name      string
+		expiresAt string
+		offset    string
+		wantError string
+	}{
+		{"Future", soon, "", ""},
+		{"Future locally, past in UTC", soon, "-180", "This field must be in the future"},
+		{"Past", "2001-01-01T00:00", "", "This field must be in the future"},
+		{"Not a date", "soon", "", "This field is not a valid date and time"},
+		{"Blank", "", "", "This field cannot be blank"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := New(url.Values{
+				"expires":    {"custom"},
+				"expires_at": {tt.expiresAt},
+				"tz_offset":  {tt.offset},
+			})
+			ValidateNewSnippet(f)
+			got := f.Errors.Get("expires_at")
+			if got != tt.wantError {
+				t.Errorf("want %q; got %q", tt.wantError, got)
+			}
+		})
+	}
+
+	f := New(url.Values{"expires": {"custom"}, "expires_at": {soon}, "tz_offset": {"5000"}})
+	ValidateNewSnippet(f)
+	if f.Errors.Get("tz_offset") == "" {
+		t.Error("want an error for an out of range offset")
+	}
+}
@@ -2,6 +2,7 @@ package models
 
 import (
    "errors"
+   "fmt"
    "time"
 )
 
@@ -13,19 +14,93 @@ var (
    // Add a new ErrDuplicateEmail error. We'll use this later if a user
    // tries to signup with an email address that's already in use.
    ErrDuplicateEmail = errors.New("models: duplicate email")
+   // ErrUnverifiedEmail is returned instead of logging a user in when their
+   // password is right but they haven't verified their email address yet.
+   ErrUnverifiedEmail = errors.New("models: unverified email")
 )
 
-// Snippet Model
+// The visibility levels a snippet can have. Public snippets appear in every
+// listing, unlisted ones can only be reached through their share link, and
+// private ones are only visible to the user who posted them.
+const (
+   VisibilityPublic = "public"
+   VisibilityUnlisted = "unlisted"
+   VisibilityPrivate = "private"
+)
+
+// Snippet Model. Author is nil for quotes posted before attribution was
+// recorded, and Year is zero when the year of the quote is unknown. UserID
+// and UserName identify the user who posted the quote, and are zero and
+// empty for quotes posted before ownership was recorded. Updated is the time
+// of the last edit, or the same as Created if the quote has never been
+// edited. Expires is zero for quotes that never expire. Deleted is the time the quote was moved to the trash, and is zero
+// for live quotes. Slug is the random identifier used in the quote's share
+// link. Tags is only populated when fetching a single snippet.
 type Snippet struct {
    ID int
    Title string
    Content string
    Created time.Time
+   Updated time.Time
    Expires time.Time
+   Deleted time.Time
+   Author *Author
+   Source string
+   Year int
+   Tags []string
+   UserID int
+   UserName string
+   Visibility string
+   Slug string
+}
+
+// Revision Model. Each revision is a saved version of a snippet's title and
+// content, along with the user who saved it.
+type Revision struct {
+   ID int
+   SnippetID int
+   UserID int
+   UserName string
+   Title string
+   Content string
+   Created time.Time
+}
+
+// Author Model. Born and Died hold years (negative for BCE) and are zero
+// when unknown.
+type Author struct {
+   ID int
+   Name string
+   Born int
+   Died int
+   Bio string
+}
+
+// Lifespan returns the author's years formatted for display, such as
+// "1828–1910", "b. 1961" or "d. 1616", or an empty string if neither is known.
+func (a *Author) Lifespan() string {
+   switch {
+   case a.Born != 0 && a.Died != 0:
+      return fmt.Sprintf("%s–%s", formatYear(a.Born), formatYear(a.Died))
+   case a.Born != 0:
+      return "b. " + formatYear(a.Born)
+   case a.Died != 0:
+      return "d. " + formatYear(a.Died)
+   }
+   return ""
+}
+
+func formatYear(y int) string {
+   if y < 0 {
+      return fmt.Sprintf("%d BCE", -y)
+   }
+   return fmt.Sprintf("%d", y)
 }
 
 // User Model. Notice how the field names and types align
-// with the columns in the database `users` table?
+// with the columns in the database `users` table? Admins may edit and
+// delete any user's quotes. Active is false for deactivated accounts, and
+// EmailVerified until the user has followed the link sent to their address.
 type User struct {
    ID int
    Name string
@@ -33,5 +108,101 @@ type User struct {
    HashedPassword []byte
    Created time.Time
    Active bool
+   EmailVerified bool
+   Admin bool
+}
+   
+// LoginFailures holds the record of failed attempts to log in to a user's
+// account since they last logged in successfully.
+type LoginFailures struct {
+   UserID int
+   Name string
+   Email string
+   Count int
+   Last time.Time
+   LockedUntil time.Time
+}
+
+// Session Model. A Session is the server-side record of a browser which is
+// logged in, kept so that users can see where they are logged in and sign
+// those browsers out. The cookie holds a random token, of which only the hash
+// is stored. Sessions which have been revoked or have expired are never
+// returned.
+type Session struct {
+   ID int
+   UserID int
+   IP string
+   UserAgent string
+   Created time.Time
+   LastSeen time.Time
+   Expires time.Time
+}
+
+// The scopes an API token can be granted. Read tokens can only fetch quotes,
+// while write tokens can also create, edit and delete them.
+const (
+   ScopeRead = "read"
+   ScopeWrite = "write"
+)
+
+// Token Model. Tokens are personal access tokens which let scripts use the
+// API on a user's behalf. Only a hash of each token is stored, so the token
+// itself can't be recovered once it has been shown to the user. LastUsed is
+// zero for tokens which have never been used.
+type Token struct {
+   ID int
+   UserID int
+   Name string
+   Scope string
+   Created time.Time
+   LastUsed time.Time
+}
+
+// The events which webhooks can subscribe to.
+const (
+   EventSnippetCreated = "snippet.created"
+   EventSnippetUpdated = "snippet.updated"
+   EventSnippetDeleted = "snippet.deleted"
+   EventUserCreated = "user.created"
+)
+
+// Events lists every webhook event, in the order they're shown to users.
+var Events = []string{EventSnippetCreated, EventSnippetUpdated, EventSnippetDeleted, EventUserCreated}
+
+// Webhook Model. Each webhook is a URL, registered by a user, which is sent
+// a JSON payload signed with Secret whenever one of Events happens.
+type Webhook struct {
+   ID int
+   UserID int
+   URL string
+   Secret string
+   Events []string
+   Created time.Time
+}
+
+// The states of a webhook delivery.
+const (
+   DeliveryPending = "pending"
+   DeliveryDelivered = "delivered"
+   DeliveryFailed = "failed"
+)
+
+// Delivery Model. A delivery is a single event payload queued for a webhook,
+// along with the outcome of the most recent attempt to send it. Pending
+// deliveries are retried at NextAttempt until they succeed or run out of
+// attempts. ResponseCode is zero if no response was received, and Webhook
+// is only populated for deliveries which are due to be sent.
+type Delivery struct {
+   ID int
+   WebhookID int
+   Webhook *Webhook
+   Event string
+   Payload string
+   Status string
+   Attempts int
+   ResponseCode int
+   Error string
+   Created time.Time
+   NextAttempt time.Time
+   Completed time.Time
 }
-   
\ No newline at end of file
@@ -0,0 +1,61 @@
+package mysql
+
+import (
+	"database/sql"
+
+	"cb.net/snippetbox/pkg/models"
+)
+
+// AuthorModel model
+type AuthorModel struct {
+	DB *sql.DB
+}
+
+// Get method to fetch details for a specific author based on their ID.
+func (m *AuthorModel) Get(id int) (*models.Author, error) {
+	a := &models.Author{}
+
+	stmt := `SELECT id, name, COALESCE(born, 0), COALESCE(died, 0), bio
+			FROM authors WHERE id = ?`
+
+	err := m.DB.QueryRow(stmt, id).Scan(&a.ID, &a.Name, &a.Born, &a.Died, &a.Bio)
+	if err == sql.ErrNoRows {
+		return nil, models.ErrNoRecord
+	} else if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// FindOrInsert method to return the ID of the author with the given name,
+// creating them with the supplied lifespan and bio if they don't exist yet.
+// The details of an existing author are left untouched.
+func (m *AuthorModel) FindOrInsert(name string, born, died int, bio string) (int, error) {
+	return findOrInsertAuthor(m.DB, name, born, died, bio)
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// findOrInsertAuthor does the work of FindOrInsert, so that it can also be
+// used inside a transaction.
+func findOrInsertAuthor(db execer, name string, born, died int, bio string) (int, error) {
+	// When the name already exists the authors_uc_name key makes the
+	// insert a no-op, and LAST_INSERT_ID(id) hands us back the existing row's
+	// ID through result.LastInsertId() just as if it had been inserted.
+	stmt := `INSERT INTO authors (name, born, died, bio) VALUES(?, ?, ?, ?)
+			ON DUPLICATE KEY UPDATE id = LAST_INSERT_ID(id)`
+
+	result, err := db.Exec(stmt, name, nullInt(born), nullInt(died), bio)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(id), nil
+}
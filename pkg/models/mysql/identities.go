@@ -0,0 +1,37 @@
+package mysql
+
+import (
+	"database/sql"
+
+	"cb.net/snippetbox/pkg/models"
+)
+
+// IdentityModel wraps a sql.DB connection pool for the user_identities
+// table, which links accounts with external OpenID Connect providers to
+// users. Identities are keyed on the provider's issuer and the subject it
+// gives the user, as those never change, unlike email addresses.
+type IdentityModel struct {
+	DB *sql.DB
+}
+
+// Get returns the ID of the user an external identity is linked to, or
+// models.ErrNoRecord if it isn't linked to anyone.
+func (m *IdentityModel) Get(issuer, subject string) (int, error) {
+	var userID int
+	stmt := "SELECT user_id FROM user_identities WHERE issuer = ? AND subject = ?"
+	err := m.DB.QueryRow(stmt, issuer, subject).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, models.ErrNoRecord
+	} else if err != nil {
+		return 0, err
+	}
+	return userID, nil
+}
+
+// Insert links an external identity to a user.
+func (m *IdentityModel) Insert(userID int, issuer, subject, email string) error {
+	stmt := `INSERT INTO user_identities (user_id, issuer, subject, email, created)
+			VALUES(?, ?, ?, ?, UTC_TIMESTAMP())`
+	_, err := m.DB.Exec(stmt, userID, issuer, subject, email)
+	return err
+}
@@ -0,0 +1,69 @@
+package mysql
+
+import (
+	"fmt"
+
+	"cb.net/snippetbox/pkg/models"
+)
+
+// keyset returns the SQL to append to a query's WHERE clause to fetch the
+// requested page, ordering on the given creation time and ID columns. It
+// asks for one row more than the page limit so callers can tell whether
+// another page follows; see trimPage.
+func keyset(p models.Page, created, id string) (string, []interface{}) {
+	switch {
+	case p.Before != nil:
+		return fmt.Sprintf(` AND (%[1]s < ? OR (%[1]s = ? AND %[2]s < ?))
+			ORDER BY %[1]s DESC, %[2]s DESC LIMIT ?`, created, id),
+			[]interface{}{p.Before.Created, p.Before.Created, p.Before.ID, p.Limit + 1}
+	case p.After != nil:
+		// Walk forwards in ascending order so the LIMIT picks the rows
+		// closest to the cursor; trimPage flips them back to newest first.
+		return fmt.Sprintf(` AND (%[1]s > ? OR (%[1]s = ? AND %[2]s > ?))
+			ORDER BY %[1]s ASC, %[2]s ASC LIMIT ?`, created, id),
+			[]interface{}{p.After.Created, p.After.Created, p.After.ID, p.Limit + 1}
+	}
+	return fmt.Sprintf(` ORDER BY %[1]s DESC, %[2]s DESC LIMIT ?`, created, id),
+		[]interface{}{p.Limit + 1}
+}
+
+// trimPage turns the rows fetched with a keyset clause into a page, dropping
+// the extra look-ahead row and setting the cursors for the neighbouring pages.
+func trimPage(p models.Page, snippets []*models.Snippet) *models.SnippetPage {
+	more := len(snippets) > p.Limit
+	if more {
+		snippets = snippets[:p.Limit]
+	}
+
+	if p.After != nil {
+		for i, j := 0, len(snippets)-1; i < j; i, j = i+1, j-1 {
+			snippets[i], snippets[j] = snippets[j], snippets[i]
+		}
+	}
+
+	page := &models.SnippetPage{Snippets: snippets}
+	if len(snippets) == 0 {
+		return page
+	}
+	first := &models.Cursor{Created: snippets[0].Created, ID: snippets[0].ID}
+	last := &models.Cursor{Created: snippets[len(snippets)-1].Created, ID: snippets[len(snippets)-1].ID}
+
+	switch {
+	case p.Before != nil:
+		// We got here by stepping back from a newer page, so one exists.
+		page.Prev = first
+		if more {
+			page.Next = last
+		}
+	case p.After != nil:
+		page.Next = last
+		if more {
+			page.Prev = first
+		}
+	default:
+		if more {
+			page.Next = last
+		}
+	}
+	return page
+}
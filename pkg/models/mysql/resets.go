@@ -0,0 +1,96 @@
+package mysql
+
+import (
+	"database/sql"
+	"time"
+
+	"cb.net/snippetbox/pkg/models"
+)
+
+// PasswordResetModel wraps a sql.DB connection pool for the password_resets
+// table. Like API tokens, reset tokens are only stored as hashes.
+type PasswordResetModel struct {
+	DB *sql.DB
+}
+
+// Insert creates a reset token for the active user with the given email
+// address, valid for the given lifetime, and returns the token. Any earlier
+// tokens for the user stop working, so only the latest email is any use. It
+// returns models.ErrNoRecord if there is no such user.
+func (m *PasswordResetModel) Insert(email string, lifetime time.Duration) (string, error) {
+	var userID int
+	row := m.DB.QueryRow("SELECT id FROM users WHERE email = ? AND active = TRUE", email)
+	err := row.Scan(&userID)
+	if err == sql.ErrNoRows {
+		return "", models.ErrNoRecord
+	} else if err != nil {
+		return "", err
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM password_resets WHERE user_id = ?", userID)
+	if err != nil {
+		return "", err
+	}
+
+	stmt := `INSERT INTO password_resets (user_id, token_hash, created, expires)
+			VALUES(?, ?, UTC_TIMESTAMP(), DATE_ADD(UTC_TIMESTAMP(), INTERVAL ? SECOND))`
+	_, err = tx.Exec(stmt, userID, hashToken(token), int(lifetime/time.Second))
+	if err != nil {
+		return "", err
+	}
+	return token, tx.Commit()
+}
+
+// Check returns the ID of the user a reset token belongs to, or
+// models.ErrNoRecord if the token is unknown, used or expired.
+func (m *PasswordResetModel) Check(token string) (int, error) {
+	var userID int
+	stmt := `SELECT user_id FROM password_resets
+			WHERE token_hash = ? AND used IS NULL AND expires > UTC_TIMESTAMP()`
+	err := m.DB.QueryRow(stmt, hashToken(token)).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, models.ErrNoRecord
+	} else if err != nil {
+		return 0, err
+	}
+	return userID, nil
+}
+
+// Consume marks a reset token as used and returns the ID of the user it
+// belongs to, or models.ErrNoRecord if the token is unknown, used or
+// expired. Marking the token used and checking it are a single statement,
+// so two requests racing with the same token can't both succeed.
+func (m *PasswordResetModel) Consume(token string) (int, error) {
+	hash := hashToken(token)
+	stmt := `UPDATE password_resets SET used = UTC_TIMESTAMP()
+			WHERE token_hash = ? AND used IS NULL AND expires > UTC_TIMESTAMP()`
+	result, err := m.DB.Exec(stmt, hash)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, models.ErrNoRecord
+	}
+
+	var userID int
+	err = m.DB.QueryRow("SELECT user_id FROM password_resets WHERE token_hash = ?", hash).Scan(&userID)
+	if err != nil {
+		return 0, err
+	}
+	return userID, nil
+}
@@ -0,0 +1,223 @@
+-- Schema for the MySQL models in this package. Run it against an empty
+-- snippetbox database; existing installs should apply the equivalent
+-- ALTER/CREATE statements for any tables or columns they are missing.
+
+CREATE TABLE users (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    name VARCHAR(255) NOT NULL,
+    email VARCHAR(255) NOT NULL,
+    hashed_password CHAR(60) NOT NULL,
+    created DATETIME NOT NULL,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    admin BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+ALTER TABLE users ADD CONSTRAINT users_uc_email UNIQUE (email);
+
+-- Authors are the people quotes are attributed to. Born and died hold years
+-- (negative for BCE) and are NULL when unknown.
+CREATE TABLE authors (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    name VARCHAR(100) NOT NULL,
+    born INTEGER NULL,
+    died INTEGER NULL,
+    bio TEXT NOT NULL
+);
+
+ALTER TABLE authors ADD CONSTRAINT authors_uc_name UNIQUE (name);
+
+CREATE TABLE snippets (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    title VARCHAR(100) NOT NULL,
+    content TEXT NOT NULL,
+    created DATETIME NOT NULL,
+    updated DATETIME NULL,
+    expires DATETIME NULL,
+    author_id INTEGER NULL,
+    source VARCHAR(255) NOT NULL DEFAULT '',
+    year INTEGER NULL,
+    user_id INTEGER NULL,
+    deleted_at DATETIME NULL,
+    visibility ENUM('public', 'unlisted', 'private') NOT NULL DEFAULT 'public',
+    slug CHAR(22) NULL,
+    FOREIGN KEY (author_id) REFERENCES authors(id),
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+ALTER TABLE snippets ADD CONSTRAINT snippets_uc_slug UNIQUE (slug);
+
+CREATE INDEX idx_snippets_created ON snippets(created);
+CREATE INDEX idx_snippets_expires ON snippets(expires);
+CREATE INDEX idx_snippets_user_created ON snippets(user_id, created);
+CREATE INDEX idx_snippets_deleted_at ON snippets(deleted_at);
+CREATE FULLTEXT INDEX idx_snippets_fulltext ON snippets(title, content);
+
+-- Expired snippets are moved here by the reaper when it runs with archiving
+-- enabled. Their tags and revisions are not kept.
+CREATE TABLE snippets_archive (
+    id INTEGER NOT NULL PRIMARY KEY,
+    title VARCHAR(100) NOT NULL,
+    content TEXT NOT NULL,
+    created DATETIME NOT NULL,
+    updated DATETIME NULL,
+    expires DATETIME NULL,
+    author_id INTEGER NULL,
+    source VARCHAR(255) NOT NULL DEFAULT '',
+    year INTEGER NULL,
+    user_id INTEGER NULL,
+    archived DATETIME NOT NULL
+);
+
+-- Tags are lowercase topic labels; snippet_tags joins them to snippets.
+CREATE TABLE tags (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    name VARCHAR(30) NOT NULL
+);
+
+ALTER TABLE tags ADD CONSTRAINT tags_uc_name UNIQUE (name);
+
+CREATE TABLE snippet_tags (
+    snippet_id INTEGER NOT NULL,
+    tag_id INTEGER NOT NULL,
+    PRIMARY KEY (snippet_id, tag_id),
+    FOREIGN KEY (snippet_id) REFERENCES snippets(id) ON DELETE CASCADE,
+    FOREIGN KEY (tag_id) REFERENCES tags(id) ON DELETE CASCADE
+);
+
+-- Every saved version of a snippet's wording, written alongside the insert
+-- or update that produced it.
+CREATE TABLE snippet_revisions (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    snippet_id INTEGER NOT NULL,
+    user_id INTEGER NULL,
+    title VARCHAR(100) NOT NULL,
+    content TEXT NOT NULL,
+    created DATETIME NOT NULL,
+    FOREIGN KEY (snippet_id) REFERENCES snippets(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+-- Personal access tokens for the API. Only the SHA-256 hash of each token is
+-- stored.
+CREATE TABLE api_tokens (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    user_id INTEGER NOT NULL,
+    name VARCHAR(100) NOT NULL,
+    scope ENUM('read', 'write') NOT NULL,
+    token_hash CHAR(64) NOT NULL,
+    created DATETIME NOT NULL,
+    last_used DATETIME NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+ALTER TABLE api_tokens ADD CONSTRAINT api_tokens_uc_token_hash UNIQUE (token_hash);
+
+-- Webhooks registered by users. events is a comma-separated list of the
+-- event names the webhook subscribes to.
+CREATE TABLE webhooks (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    user_id INTEGER NOT NULL,
+    url VARCHAR(2048) NOT NULL,
+    secret VARCHAR(255) NOT NULL,
+    events VARCHAR(255) NOT NULL,
+    created DATETIME NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- The delivery log: one row per event queued for a webhook, updated after
+-- every attempt to send it.
+CREATE TABLE webhook_deliveries (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    webhook_id INTEGER NOT NULL,
+    event VARCHAR(50) NOT NULL,
+    payload TEXT NOT NULL,
+    status ENUM('pending', 'delivered', 'failed') NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    response_code INTEGER NULL,
+    error VARCHAR(255) NOT NULL DEFAULT '',
+    created DATETIME NOT NULL,
+    next_attempt DATETIME NULL,
+    completed DATETIME NULL,
+    FOREIGN KEY (webhook_id) REFERENCES webhooks(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_webhook_deliveries_due ON webhook_deliveries(status, next_attempt);
+CREATE INDEX idx_webhook_deliveries_webhook ON webhook_deliveries(webhook_id, created);
+
+-- Password reset tokens. Only the SHA-256 hash of each token is stored, and
+-- each user has at most one row, as requesting a new token replaces the old.
+CREATE TABLE password_resets (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    user_id INTEGER NOT NULL,
+    token_hash CHAR(64) NOT NULL,
+    created DATETIME NOT NULL,
+    expires DATETIME NOT NULL,
+    used DATETIME NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+ALTER TABLE password_resets ADD CONSTRAINT password_resets_uc_token_hash UNIQUE (token_hash);
+
+-- Whether each user has proved that their email address is theirs. New
+-- accounts can't log in until they have. This is kept apart from active,
+-- which is for accounts that have been deactivated. Accounts which existed
+-- before verification was added count as verified.
+ALTER TABLE users ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT TRUE;
+
+-- Two-factor authentication. totp_secret is NULL for users who haven't turned
+-- it on; totp_last_step is the period of the last code they logged in with,
+-- which stops codes being replayed.
+ALTER TABLE users ADD COLUMN totp_secret VARCHAR(64) NULL;
+ALTER TABLE users ADD COLUMN totp_last_step BIGINT NOT NULL DEFAULT 0;
+
+-- Single-use recovery codes for logging in without the authenticator app.
+-- Only the SHA-256 hash of each code is stored.
+CREATE TABLE recovery_codes (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    user_id INTEGER NOT NULL,
+    code_hash CHAR(64) NOT NULL,
+    created DATETIME NOT NULL,
+    used DATETIME NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_recovery_codes_user ON recovery_codes(user_id, code_hash);
+
+-- Failed login attempts since each user's last successful login, and when
+-- any lockout that followed them ends.
+ALTER TABLE users ADD COLUMN failed_logins INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN last_failed_login DATETIME NULL;
+ALTER TABLE users ADD COLUMN locked_until DATETIME NULL;
+
+-- Logged in browser sessions. The session cookie holds a random token, of
+-- which only the SHA-256 hash is stored, and a session stops working as soon
+-- as it is revoked, whatever the cookie says.
+CREATE TABLE user_sessions (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    user_id INTEGER NOT NULL,
+    token_hash CHAR(64) NOT NULL,
+    ip VARCHAR(45) NOT NULL,
+    user_agent VARCHAR(255) NOT NULL,
+    created DATETIME NOT NULL,
+    last_seen DATETIME NOT NULL,
+    expires DATETIME NOT NULL,
+    revoked DATETIME NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+ALTER TABLE user_sessions ADD CONSTRAINT user_sessions_uc_token_hash UNIQUE (token_hash);
+CREATE INDEX idx_user_sessions_user ON user_sessions(user_id, last_seen);
+
+-- Accounts with external OpenID Connect providers which users log in with.
+-- email is the address the provider gave when the identity was linked.
+CREATE TABLE user_identities (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    user_id INTEGER NOT NULL,
+    issuer VARCHAR(255) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    email VARCHAR(255) NOT NULL,
+    created DATETIME NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+ALTER TABLE user_identities ADD CONSTRAINT user_identities_uc_subject UNIQUE (issuer, subject);
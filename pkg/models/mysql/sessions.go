@@ -0,0 +1,117 @@
+package mysql
+
+import (
+	"database/sql"
+	"time"
+	"unicode/utf8"
+
+	"cb.net/snippetbox/pkg/models"
+)
+
+// maxUserAgent is the length of the user_sessions.user_agent column.
+const maxUserAgent = 255
+
+// SessionModel wraps a sql.DB connection pool for the user_sessions table.
+// Like API tokens, session tokens are only stored as hashes.
+type SessionModel struct {
+	DB *sql.DB
+}
+
+// Insert records a new session for the user, from the given IP address and
+// user agent, which expires after lifetime, and returns its token.
+func (m *SessionModel) Insert(userID int, ip, userAgent string, lifetime time.Duration) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	// User agents are only shown to help people recognise their sessions, so
+	// overlong ones are cut short rather than refused.
+	for len(userAgent) > maxUserAgent {
+		_, size := utf8.DecodeLastRuneInString(userAgent)
+		userAgent = userAgent[:len(userAgent)-size]
+	}
+
+	stmt := `INSERT INTO user_sessions (user_id, token_hash, ip, user_agent, created, last_seen, expires)
+			VALUES(?, ?, ?, ?, UTC_TIMESTAMP(), UTC_TIMESTAMP(), DATE_ADD(UTC_TIMESTAMP(), INTERVAL ? SECOND))`
+	_, err = m.DB.Exec(stmt, userID, hashToken(token), ip, userAgent, int(lifetime/time.Second))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Get returns the session with the given token. It returns ErrNoRecord if
+// the token is unknown, or the session has been revoked or has expired.
+func (m *SessionModel) Get(token string) (*models.Session, error) {
+	s := &models.Session{}
+	stmt := `SELECT id, user_id, ip, user_agent, created, last_seen, expires FROM user_sessions
+			WHERE token_hash = ? AND revoked IS NULL AND expires > UTC_TIMESTAMP()`
+	err := m.DB.QueryRow(stmt, hashToken(token)).Scan(&s.ID, &s.UserID, &s.IP, &s.UserAgent, &s.Created, &s.LastSeen, &s.Expires)
+	if err == sql.ErrNoRows {
+		return nil, models.ErrNoRecord
+	} else if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Touch records that a session has been used, from the given IP address.
+func (m *SessionModel) Touch(id int, ip string) error {
+	_, err := m.DB.Exec("UPDATE user_sessions SET last_seen = UTC_TIMESTAMP(), ip = ? WHERE id = ?", ip, id)
+	return err
+}
+
+// ForUser returns a user's current sessions, most recently used first.
+func (m *SessionModel) ForUser(userID int) ([]*models.Session, error) {
+	stmt := `SELECT id, user_id, ip, user_agent, created, last_seen, expires FROM user_sessions
+			WHERE user_id = ? AND revoked IS NULL AND expires > UTC_TIMESTAMP()
+			ORDER BY last_seen DESC, id DESC`
+	rows, err := m.DB.Query(stmt, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*models.Session{}
+	for rows.Next() {
+		s := &models.Session{}
+		err = rows.Scan(&s.ID, &s.UserID, &s.IP, &s.UserAgent, &s.Created, &s.LastSeen, &s.Expires)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// Revoke signs out one of the user's sessions. It returns ErrNoRecord if
+// the user has no current session with that ID.
+func (m *SessionModel) Revoke(id, userID int) error {
+	stmt := `UPDATE user_sessions SET revoked = UTC_TIMESTAMP()
+			WHERE id = ? AND user_id = ? AND revoked IS NULL`
+	result, err := m.DB.Exec(stmt, id, userID)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return models.ErrNoRecord
+	}
+	return nil
+}
+
+// RevokeOthers signs out all of the user's sessions except the one with the
+// ID keep. Passing a keep of zero signs out every session.
+func (m *SessionModel) RevokeOthers(userID, keep int) error {
+	stmt := `UPDATE user_sessions SET revoked = UTC_TIMESTAMP()
+			WHERE user_id = ? AND id <> ? AND revoked IS NULL`
+	_, err := m.DB.Exec(stmt, userID, keep)
+	return err
+}
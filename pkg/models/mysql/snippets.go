@@ -1,8 +1,15 @@
 package mysql
 
 import (
+   "crypto/rand"
    "database/sql"
+   "encoding/base64"
+   "strings"
+   "time"
+
    "cb.net/snippetbox/pkg/models"
+
+   "github.com/go-sql-driver/mysql"
 )
 
 // Define a SnippetModel type which wraps a sql.DB connection pool.
@@ -10,42 +17,435 @@ type SnippetModel struct {
    DB *sql.DB
 }
 
-// This will insert a new snippet into the database.
-func (m *SnippetModel) Insert(title, content, expires string) (int, error) {
+// snippetSelect is the common SELECT used by every snippet query. It joins
+// the authors and users tables so that each snippet carries its attribution
+// and owner, and the column order must match the Scan() call in scanSnippet.
+const snippetSelect = `SELECT s.id, s.title, s.content, s.created,
+            COALESCE(s.updated, s.created), s.expires,
+            s.source, COALESCE(s.year, 0), COALESCE(a.id, 0), COALESCE(a.name, ''),
+            COALESCE(a.born, 0), COALESCE(a.died, 0), COALESCE(a.bio, ''),
+            COALESCE(s.user_id, 0), COALESCE(u.name, ''), s.deleted_at,
+            s.visibility, COALESCE(s.slug, '')
+            FROM snippets s LEFT JOIN authors a ON a.id = s.author_id
+            LEFT JOIN users u ON u.id = s.user_id`
+
+// live is the WHERE condition matching snippets that can be shown: those
+// that haven't expired or been moved to the trash. A NULL expiry time means
+// the snippet never expires.
+const live = `(s.expires IS NULL OR s.expires > UTC_TIMESTAMP()) AND s.deleted_at IS NULL`
+
+// listed is the WHERE condition for the public listings, which only show
+// live snippets whose visibility is public.
+const listed = live + ` AND s.visibility = 'public'`
+
+// scanner is satisfied by both *sql.Row and *sql.Rows.
+type scanner interface {
+   Scan(dest ...interface{}) error
+}
+
+// scanSnippet copies the columns selected by snippetSelect into a new
+// Snippet. Snippets without an author are returned with a nil Author.
+func scanSnippet(row scanner) (*models.Snippet, error) {
+   s := &models.Snippet{}
+   a := &models.Author{}
+   var expires, deleted mysql.NullTime
+   err := row.Scan(&s.ID, &s.Title, &s.Content, &s.Created, &s.Updated, &expires,
+      &s.Source, &s.Year, &a.ID, &a.Name, &a.Born, &a.Died, &a.Bio,
+      &s.UserID, &s.UserName, &deleted, &s.Visibility, &s.Slug)
+   if err != nil {
+      return nil, err
+   }
+   if a.ID != 0 {
+      s.Author = a
+   }
+   s.Expires = expires.Time
+   s.Deleted = deleted.Time
+   return s, nil
+}
+
+// nullInt maps the zero value to NULL for optional integer columns.
+func nullInt(i int) interface{} {
+   if i == 0 {
+      return nil
+   }
+   return i
+}
+
+// newSlug returns a random 22 character URL-safe identifier, carrying 128
+// bits of entropy, for use in share links.
+func newSlug() (string, error) {
+   b := make([]byte, 16)
+   if _, err := rand.Read(b); err != nil {
+      return "", err
+   }
+   return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// nullTime maps the zero time to NULL for optional DATETIME columns.
+func nullTime(t time.Time) interface{} {
+   if t.IsZero() {
+      return nil
+   }
+   return t.UTC()
+}
+
+// This will insert a new snippet and its tags into the database, owned by
+// s.UserID. A nil Author or a zero Year is stored as NULL, as is a zero
+// Expires time for snippets that never expire. Every snippet is given a
+// random slug for its share link.
+func (m *SnippetModel) Insert(s *models.Snippet) (int, error) {
+   // The snippet and its tag links are written in a single transaction so
+   // that a failure part way through never leaves a half-tagged snippet.
+   tx, err := m.DB.Begin()
+   if err != nil {
+      return 0, err
+   }
+   defer tx.Rollback()
+
+   id, err := insert(tx, s)
+   if err != nil {
+      return 0, err
+   }
+   if err = tx.Commit(); err != nil {
+      return 0, err
+   }
+   return id, nil
+}
+
+// InsertMany inserts a batch of snippets, such as an import, in a single
+// transaction: either all of them are added or, if there's an error, none
+// are. Unlike Insert it also creates the snippets' authors, so authors with
+// no ID are looked up or added by name within the same transaction. It
+// returns the IDs of the new snippets in order.
+func (m *SnippetModel) InsertMany(snippets []*models.Snippet) ([]int, error) {
+   tx, err := m.DB.Begin()
+   if err != nil {
+      return nil, err
+   }
+   defer tx.Rollback()
+
+   ids := make([]int, 0, len(snippets))
+   for _, s := range snippets {
+      if a := s.Author; a != nil && a.ID == 0 && a.Name != "" {
+         a.ID, err = findOrInsertAuthor(tx, a.Name, a.Born, a.Died, a.Bio)
+         if err != nil {
+            return nil, err
+         }
+      }
+      id, err := insert(tx, s)
+      if err != nil {
+         return nil, err
+      }
+      ids = append(ids, id)
+   }
+   if err = tx.Commit(); err != nil {
+      return nil, err
+   }
+   return ids, nil
+}
+
+// insert writes a snippet, its tags and its first revision using tx, and
+// returns the new snippet's ID.
+func insert(tx *sql.Tx, s *models.Snippet) (int, error) {
+   slug, err := newSlug()
+   if err != nil {
+      return 0, err
+   }
+
    // Write the SQL statement we want to execute. I've split it over two lines
    // for readability (which is why it's surrounded with backquotes instead
    // of normal double quotes).
-   stmt := `INSERT INTO snippets (title, content, created, expires)
-            VALUES(?, ?, UTC_TIMESTAMP(), DATE_ADD(UTC_TIMESTAMP(), INTERVAL ? DAY))`
+   stmt := `INSERT INTO snippets (title, content, created, expires, author_id, source, year,
+            user_id, visibility, slug)
+            VALUES(?, ?, UTC_TIMESTAMP(), ?, ?, ?, ?, ?, ?, ?)`
 
-   // Use the Exec() method on the embedded connection pool to execute the
-   // statement. The first parameter is the SQL statement, followed by the
-   // title, content and expiry values for the placeholder parameters. This
-   // method returns a sql.Result object, which contains some basic
-   // information about what happened when the statement was executed.
-   result, err := m.DB.Exec(stmt, title, content, expires)
+   // Use the Exec() method on the transaction to execute the statement. The
+   // first parameter is the SQL statement, followed by the values for the
+   // placeholder parameters. This method returns a sql.Result object, which
+   // contains some basic information about what happened when the statement
+   // was executed.
+   result, err := tx.Exec(stmt, s.Title, s.Content, nullTime(s.Expires), nullInt(authorID(s)),
+      s.Source, nullInt(s.Year), s.UserID, s.Visibility, slug)
    if err != nil {
       return 0, err
    }
 
    // Use the LastInsertId() method on the result object to get the ID of our
-   // newly inserted record in the snippets table.
+   // newly inserted record in the snippets table. The ID returned has the
+   // type int64, so we convert it to an int type.
    id, err := result.LastInsertId()
    if err != nil {
       return 0, err
    }
 
-   // The ID returned has the type int64, so we convert it to an int type
-   // before returning.
+   if err = setTags(tx, int(id), s.Tags); err != nil {
+      return 0, err
+   }
+   if err = addRevision(tx, int(id), s.UserID); err != nil {
+      return 0, err
+   }
    return int(id), nil
 }
 
+// Update replaces the content, attribution, visibility and tags of the
+// snippet with ID s.ID, records the time of the edit and saves the new
+// wording as a revision by the given user. The expiry time and owner are left
+// unchanged.
+func (m *SnippetModel) Update(s *models.Snippet, userID int) error {
+   // Snippets posted before share links existed are given a slug the first
+   // time they're edited, in case they're being made unlisted.
+   slug, err := newSlug()
+   if err != nil {
+      return err
+   }
+
+   tx, err := m.DB.Begin()
+   if err != nil {
+      return err
+   }
+   defer tx.Rollback()
+
+   id := s.ID
+
+   // Lock the snippet for the rest of the edit, and make sure it exists and
+   // isn't in the trash. The UPDATE below can't tell us that, as it affects
+   // no rows when nothing in the snippet changes.
+   err = tx.QueryRow(`SELECT id FROM snippets WHERE id = ? AND deleted_at IS NULL FOR UPDATE`, id).Scan(&id)
+   if err == sql.ErrNoRows {
+      return models.ErrNoRecord
+   } else if err != nil {
+      return err
+   }
+
+   // Snippets posted before revisions were kept have no history, so save
+   // their current wording as the first revision before it's overwritten.
+   stmt := `INSERT INTO snippet_revisions (snippet_id, user_id, title, content, created)
+            SELECT id, user_id, title, content, COALESCE(updated, created) FROM snippets
+            WHERE id = ? AND NOT EXISTS (SELECT 1 FROM snippet_revisions WHERE snippet_id = ?)`
+   if _, err = tx.Exec(stmt, id, id); err != nil {
+      return err
+   }
+
+   stmt = `UPDATE snippets SET title = ?, content = ?, author_id = ?, source = ?, year = ?,
+            visibility = ?, slug = COALESCE(slug, ?), updated = UTC_TIMESTAMP()
+            WHERE id = ?`
+   _, err = tx.Exec(stmt, s.Title, s.Content, nullInt(authorID(s)), s.Source, nullInt(s.Year),
+      s.Visibility, slug, id)
+   if err != nil {
+      return err
+   }
+
+   // Replace the tag links wholesale rather than working out the difference.
+   if _, err = tx.Exec(`DELETE FROM snippet_tags WHERE snippet_id = ?`, id); err != nil {
+      return err
+   }
+   if err = setTags(tx, id, s.Tags); err != nil {
+      return err
+   }
+   if err = addRevision(tx, id, userID); err != nil {
+      return err
+   }
+   return tx.Commit()
+}
+
+// authorID returns the ID of the snippet's author, or zero if it has none.
+func authorID(s *models.Snippet) int {
+   if s.Author == nil {
+      return 0
+   }
+   return s.Author.ID
+}
+
+// addRevision saves the current title and content of a snippet as a new
+// revision by the given user.
+func addRevision(tx *sql.Tx, snippetID, userID int) error {
+   stmt := `INSERT INTO snippet_revisions (snippet_id, user_id, title, content, created)
+            SELECT id, ?, title, content, UTC_TIMESTAMP() FROM snippets WHERE id = ?`
+   _, err := tx.Exec(stmt, nullInt(userID), snippetID)
+   return err
+}
+
+// revisionSelect is the common SELECT used by the revision queries.
+const revisionSelect = `SELECT r.id, r.snippet_id, COALESCE(r.user_id, 0), COALESCE(u.name, ''),
+            r.title, r.content, r.created
+            FROM snippet_revisions r LEFT JOIN users u ON u.id = r.user_id`
+
+// Revisions returns every saved revision of a snippet, newest first.
+func (m *SnippetModel) Revisions(snippetID int) ([]*models.Revision, error) {
+   rows, err := m.DB.Query(revisionSelect+` WHERE r.snippet_id = ? ORDER BY r.id DESC`, snippetID)
+   if err != nil {
+      return nil, err
+   }
+   defer rows.Close()
+
+   revisions := []*models.Revision{}
+   for rows.Next() {
+      rev := &models.Revision{}
+      err = rows.Scan(&rev.ID, &rev.SnippetID, &rev.UserID, &rev.UserName, &rev.Title, &rev.Content, &rev.Created)
+      if err != nil {
+         return nil, err
+      }
+      revisions = append(revisions, rev)
+   }
+   if err = rows.Err(); err != nil {
+      return nil, err
+   }
+   return revisions, nil
+}
+
+// Revision returns a single revision of a snippet.
+func (m *SnippetModel) Revision(snippetID, id int) (*models.Revision, error) {
+   rev := &models.Revision{}
+   row := m.DB.QueryRow(revisionSelect+` WHERE r.snippet_id = ? AND r.id = ?`, snippetID, id)
+   err := row.Scan(&rev.ID, &rev.SnippetID, &rev.UserID, &rev.UserName, &rev.Title, &rev.Content, &rev.Created)
+   if err == sql.ErrNoRows {
+      return nil, models.ErrNoRecord
+   } else if err != nil {
+      return nil, err
+   }
+   return rev, nil
+}
+
+// Delete moves a snippet to its owner's trash. It stays there, hidden from
+// every other query, until it is restored or purged.
+func (m *SnippetModel) Delete(id int) error {
+   stmt := `UPDATE snippets SET deleted_at = UTC_TIMESTAMP() WHERE id = ? AND deleted_at IS NULL`
+   return m.execOne(stmt, id)
+}
+
+// Trash returns the snippets in the given user's trash, most recently
+// deleted first.
+func (m *SnippetModel) Trash(userID int) ([]*models.Snippet, error) {
+   stmt := snippetSelect + ` WHERE s.deleted_at IS NOT NULL AND s.user_id = ?
+            ORDER BY s.deleted_at DESC`
+   return m.query(stmt, userID)
+}
+
+// Restore takes a snippet out of the given user's trash.
+func (m *SnippetModel) Restore(id, userID int) error {
+   stmt := `UPDATE snippets SET deleted_at = NULL
+            WHERE id = ? AND user_id = ? AND deleted_at IS NOT NULL`
+   return m.execOne(stmt, id, userID)
+}
+
+// Purge permanently removes a snippet from the given user's trash, along
+// with its tag links and revisions.
+func (m *SnippetModel) Purge(id, userID int) error {
+   stmt := `DELETE FROM snippets WHERE id = ? AND user_id = ? AND deleted_at IS NOT NULL`
+   return m.execOne(stmt, id, userID)
+}
+
+// PurgeDeleted permanently removes every snippet that was moved to the trash
+// before the given time, and returns how many were removed.
+func (m *SnippetModel) PurgeDeleted(before time.Time) (int, error) {
+   result, err := m.DB.Exec(`DELETE FROM snippets WHERE deleted_at < ?`, before)
+   if err != nil {
+      return 0, err
+   }
+   n, err := result.RowsAffected()
+   return int(n), err
+}
+
+// PurgeExpired permanently removes up to limit snippets that expired before
+// the given time, and returns how many were removed. If archive is true the
+// snippets are first copied to the snippets_archive table, in the same
+// transaction as the delete.
+func (m *SnippetModel) PurgeExpired(before time.Time, limit int, archive bool) (int, error) {
+   tx, err := m.DB.Begin()
+   if err != nil {
+      return 0, err
+   }
+   defer tx.Rollback()
+
+   // Lock the batch of rows first so that the archive copy and the delete
+   // are guaranteed to act on exactly the same snippets.
+   rows, err := tx.Query(`SELECT id FROM snippets WHERE expires IS NOT NULL AND expires < ?
+            ORDER BY id LIMIT ? FOR UPDATE`, before, limit)
+   if err != nil {
+      return 0, err
+   }
+   defer rows.Close()
+
+   ids := []interface{}{}
+   for rows.Next() {
+      var id int
+      if err = rows.Scan(&id); err != nil {
+         return 0, err
+      }
+      ids = append(ids, id)
+   }
+   if err = rows.Err(); err != nil {
+      return 0, err
+   }
+   if len(ids) == 0 {
+      return 0, nil
+   }
+   in := "(?" + strings.Repeat(", ?", len(ids)-1) + ")"
+
+   if archive {
+      stmt := `INSERT INTO snippets_archive (id, title, content, created, updated, expires,
+               author_id, source, year, user_id, archived)
+               SELECT id, title, content, created, updated, expires, author_id, source, year,
+               user_id, UTC_TIMESTAMP() FROM snippets WHERE id IN ` + in
+      if _, err = tx.Exec(stmt, ids...); err != nil {
+         return 0, err
+      }
+   }
+
+   result, err := tx.Exec(`DELETE FROM snippets WHERE id IN `+in, ids...)
+   if err != nil {
+      return 0, err
+   }
+   n, err := result.RowsAffected()
+   if err != nil {
+      return 0, err
+   }
+   return int(n), tx.Commit()
+}
+
+// execOne executes a statement that should change exactly one snippet, and
+// returns models.ErrNoRecord if it matched none.
+func (m *SnippetModel) execOne(stmt string, args ...interface{}) error {
+   result, err := m.DB.Exec(stmt, args...)
+   if err != nil {
+      return err
+   }
+   if n, err := result.RowsAffected(); err != nil {
+      return err
+   } else if n == 0 {
+      return models.ErrNoRecord
+   }
+   return nil
+}
+
+// setTags links a snippet to each of the named tags, creating any tags that
+// don't exist yet.
+func setTags(tx *sql.Tx, snippetID int, tags []string) error {
+   for _, tag := range tags {
+      // As with authors, LAST_INSERT_ID(id) returns the existing tag's ID
+      // when the name is already taken.
+      result, err := tx.Exec(`INSERT INTO tags (name) VALUES(?)
+            ON DUPLICATE KEY UPDATE id = LAST_INSERT_ID(id)`, tag)
+      if err != nil {
+         return err
+      }
+      tagID, err := result.LastInsertId()
+      if err != nil {
+         return err
+      }
+      _, err = tx.Exec(`INSERT IGNORE INTO snippet_tags (snippet_id, tag_id) VALUES(?, ?)`, snippetID, tagID)
+      if err != nil {
+         return err
+      }
+   }
+   return nil
+}
+
 // This will return a specific snippet based on its id.
 func (m *SnippetModel) Get(id int) (*models.Snippet, error) {
    // Write the SQL statement we want to execute. Again, I've split it over two
    // lines for readability.
-   stmt := `SELECT id, title, content, created, expires FROM snippets
-            WHERE expires > UTC_TIMESTAMP() AND id = ?`
+   stmt := snippetSelect + ` WHERE ` + live + ` AND s.id = ?`
 
    // Use the QueryRow() method on the connection pool to execute our
    // SQL statement, passing in the untrusted id variable as the value for the
@@ -53,41 +453,172 @@ func (m *SnippetModel) Get(id int) (*models.Snippet, error) {
    // holds the result from the database.
    row := m.DB.QueryRow(stmt, id)
 
-   // Initialize a pointer to a new zeroed Snippet struct.
-   s := &models.Snippet{}
-
-   // Use row.Scan() to copy the values from each field in sql.Row to the
-   // corresponding field in the Snippet struct. Notice that the arguments
-   // to row.Scan are *pointers* to the place you want to copy the data into,
-   // and the number of arguments must be exactly the same as the number of
-   // columns returned by your statement. If the query returns no rows, then
-   // row.Scan() will return a sql.ErrNoRows error. We check for that and return
-   // our own models.ErrNoRecord error instead of a Snippet object.
-   err := row.Scan(&s.ID, &s.Title, &s.Content, &s.Created, &s.Expires)
+   // Use scanSnippet() to copy the values from each field in sql.Row to a
+   // new Snippet struct. If the query returns no rows, then row.Scan() will
+   // return a sql.ErrNoRows error. We check for that and return our own
+   // models.ErrNoRecord error instead of a Snippet object.
+   s, err := scanSnippet(row)
    if err == sql.ErrNoRows {
       return nil, models.ErrNoRecord
    } else if err != nil {
       return nil, err
    }
+
+   s.Tags, err = m.tags(s.ID)
+   if err != nil {
+      return nil, err
+   }
    // If everything went OK then return the Snippet object.
    return s, nil
 }
 
-// This will return the 10 most recently created snippets.
-func (m *SnippetModel) Latest() ([]*models.Snippet, error) {
-   // Write the SQL statement we want to execute.
-   stmt := `SELECT id, title, content, created, expires FROM snippets
-            WHERE expires > UTC_TIMESTAMP() ORDER BY created DESC LIMIT 10`
+// This will return a page of the most recently created public snippets.
+func (m *SnippetModel) Latest(p models.Page) (*models.SnippetPage, error) {
+   // Write the SQL statement we want to execute. The keyset clause for the
+   // requested page is appended by m.page().
+   stmt := snippetSelect + ` WHERE ` + listed
+   return m.page(stmt, p)
+}
+
+// ByAuthor returns a page of the public, unexpired snippets attributed to
+// the given author, most recent first.
+func (m *SnippetModel) ByAuthor(authorID int, p models.Page) (*models.SnippetPage, error) {
+   stmt := snippetSelect + ` WHERE ` + listed + ` AND s.author_id = ?`
+   return m.page(stmt, p, authorID)
+}
+
+// GetBySlug returns the live snippet with the given share link slug.
+func (m *SnippetModel) GetBySlug(slug string) (*models.Snippet, error) {
+   stmt := snippetSelect + ` WHERE ` + live + ` AND s.slug = ?`
+   s, err := scanSnippet(m.DB.QueryRow(stmt, slug))
+   if err == sql.ErrNoRows {
+      return nil, models.ErrNoRecord
+   } else if err != nil {
+      return nil, err
+   }
+
+   s.Tags, err = m.tags(s.ID)
+   if err != nil {
+      return nil, err
+   }
+   return s, nil
+}
+
+// Tagged returns a page of the public, unexpired snippets carrying the given
+// tag, most recent first.
+func (m *SnippetModel) Tagged(tag string, p models.Page) (*models.SnippetPage, error) {
+   stmt := snippetSelect + ` JOIN snippet_tags st ON st.snippet_id = s.id
+            JOIN tags t ON t.id = st.tag_id
+            WHERE ` + listed + ` AND t.name = ?`
+   return m.page(stmt, p, tag)
+}
+
+// Export returns every live snippet posted by the given user, or by anyone
+// if userID is zero, oldest first and with their tags, for writing out to a
+// file.
+func (m *SnippetModel) Export(userID int) ([]*models.Snippet, error) {
+   stmt := snippetSelect + ` WHERE ` + live + ` AND (? = 0 OR s.user_id = ?)
+            ORDER BY s.created, s.id`
+   snippets, err := m.query(stmt, userID, userID)
+   if err != nil {
+      return nil, err
+   }
+
+   // Fetch the tags for all of the snippets in one go, rather than one
+   // query per snippet.
+   rows, err := m.DB.Query(`SELECT st.snippet_id, t.name FROM snippet_tags st
+            JOIN tags t ON t.id = st.tag_id JOIN snippets s ON s.id = st.snippet_id
+            WHERE `+live+` AND (? = 0 OR s.user_id = ?) ORDER BY t.name`, userID, userID)
+   if err != nil {
+      return nil, err
+   }
+   defer rows.Close()
+
+   tags := map[int][]string{}
+   for rows.Next() {
+      var id int
+      var name string
+      if err = rows.Scan(&id, &name); err != nil {
+         return nil, err
+      }
+      tags[id] = append(tags[id], name)
+   }
+   if err = rows.Err(); err != nil {
+      return nil, err
+   }
+
+   for _, s := range snippets {
+      s.Tags = tags[s.ID]
+   }
+   return snippets, nil
+}
+
+// ByUser returns a page of the unexpired snippets posted by the given user,
+// most recent first, whatever their visibility.
+func (m *SnippetModel) ByUser(userID int, p models.Page) (*models.SnippetPage, error) {
+   stmt := snippetSelect + ` WHERE ` + live + ` AND s.user_id = ?`
+   return m.page(stmt, p, userID)
+}
+
+// Search returns up to limit public, unexpired snippets whose title or
+// content match the query, skipping the first offset results. Matches are
+// ordered by relevance and then by age, most recent first.
+func (m *SnippetModel) Search(query string, limit, offset int) ([]*models.Snippet, error) {
+   stmt := snippetSelect + ` WHERE ` + listed + `
+            AND MATCH(s.title, s.content) AGAINST(? IN NATURAL LANGUAGE MODE)
+            ORDER BY MATCH(s.title, s.content) AGAINST(? IN NATURAL LANGUAGE MODE) DESC, s.created DESC
+            LIMIT ? OFFSET ?`
+   return m.query(stmt, query, query, limit, offset)
+}
+
+// tags returns the names of the tags on a snippet in alphabetical order.
+func (m *SnippetModel) tags(snippetID int) ([]string, error) {
+   stmt := `SELECT t.name FROM tags t JOIN snippet_tags st ON st.tag_id = t.id
+            WHERE st.snippet_id = ? ORDER BY t.name`
+   rows, err := m.DB.Query(stmt, snippetID)
+   if err != nil {
+      return nil, err
+   }
+   defer rows.Close()
+
+   tags := []string{}
+   for rows.Next() {
+      var tag string
+      if err = rows.Scan(&tag); err != nil {
+         return nil, err
+      }
+      tags = append(tags, tag)
+   }
+   if err = rows.Err(); err != nil {
+      return nil, err
+   }
+   return tags, nil
+}
+
+// page appends the keyset clause for p to a statement built on snippetSelect
+// and returns the resulting page.
+func (m *SnippetModel) page(stmt string, p models.Page, args ...interface{}) (*models.SnippetPage, error) {
+   clause, pageArgs := keyset(p, "s.created", "s.id")
+   snippets, err := m.query(stmt+clause, append(args, pageArgs...)...)
+   if err != nil {
+      return nil, err
+   }
+   return trimPage(p, snippets), nil
+}
+
+// query runs a statement built on snippetSelect and returns every row it
+// produces.
+func (m *SnippetModel) query(stmt string, args ...interface{}) ([]*models.Snippet, error) {
    // Use the Query() method on the connection pool to execute our
    // SQL statement. This returns a sql.Rows resultset containing the result of
    // our query.
-   rows, err := m.DB.Query(stmt)
+   rows, err := m.DB.Query(stmt, args...)
    if err != nil {
       return nil, err
    }
 
    // We defer rows.Close() to ensure the sql.Rows resultset is
-   // always properly closed before the Latest() method returns. This defer
+   // always properly closed before the method returns. This defer
    // statement should come *after* you check for an error from the Query()
    // method. Otherwise, if Query() returns an error, you'll get a panic
    // trying to close a nil resultset.
@@ -100,18 +631,9 @@ func (m *SnippetModel) Latest() ([]*models.Snippet, error) {
    // prepares the first (and then each subsequent) row to be acted on by the
    // rows.Scan() method. If iteration over all the rows completes then the
    // resultset automatically closes itself and frees-up the underlying
-   // resultset automatically closes itself and frees-up the underlying
    // database connection.
    for rows.Next() {
-      // Create a pointer to a new zeroed Snippet struct.
-      s := &models.Snippet{}
-
-      // Use rows.Scan() to copy the values from each field in the row to the
-      // new Snippet object that we created. Again, the arguments to row.Scan()
-      // must be pointers to the place you want to copy the data into, and the
-      // number of arguments must be exactly the same as the number of
-      // columns returned by your statement.
-      err = rows.Scan(&s.ID, &s.Title, &s.Content, &s.Created, &s.Expires)
+      s, err := scanSnippet(rows)
       if err != nil {
          return nil, err
       }
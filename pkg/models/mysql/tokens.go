@@ -0,0 +1,131 @@
+package mysql
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+
+	"cb.net/snippetbox/pkg/models"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// tokenPrefix marks personal access tokens, so that they are easy to tell
+// apart from other bearer tokens and to spot if they leak.
+const tokenPrefix = "qb_"
+
+// TokenModel wraps a sql.DB connection pool for the api_tokens table.
+type TokenModel struct {
+	DB *sql.DB
+}
+
+// hashToken returns the hex-encoded SHA-256 hash under which a token is
+// stored. Tokens carry 256 bits of randomness, so a fast unsalted hash is
+// enough to make a leaked table useless.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomToken returns 256 random bits, encoded so as to be safe in URLs.
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Insert creates a new token for the user with the given name and scope,
+// and returns the token itself. This is the only time the token is
+// available, as only its hash is stored.
+func (m *TokenModel) Insert(userID int, name, scope string) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	token = tokenPrefix + token
+
+	stmt := `INSERT INTO api_tokens (user_id, name, scope, token_hash, created)
+			VALUES(?, ?, ?, ?, UTC_TIMESTAMP())`
+	_, err = m.DB.Exec(stmt, userID, name, scope, hashToken(token))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// ForUser returns all of a user's tokens, newest first.
+func (m *TokenModel) ForUser(userID int) ([]*models.Token, error) {
+	stmt := `SELECT id, user_id, name, scope, created, last_used FROM api_tokens
+			WHERE user_id = ? ORDER BY created DESC, id DESC`
+	rows, err := m.DB.Query(stmt, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []*models.Token{}
+	for rows.Next() {
+		t := &models.Token{}
+		var lastUsed mysql.NullTime
+		err = rows.Scan(&t.ID, &t.UserID, &t.Name, &t.Scope, &t.Created, &lastUsed)
+		if err != nil {
+			return nil, err
+		}
+		t.LastUsed = lastUsed.Time
+		tokens = append(tokens, t)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// Revoke deletes one of the user's tokens. It returns ErrNoRecord if the
+// user has no token with that ID.
+func (m *TokenModel) Revoke(id, userID int) error {
+	result, err := m.DB.Exec("DELETE FROM api_tokens WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return models.ErrNoRecord
+	}
+	return nil
+}
+
+// Authenticate looks up a token by its value and records that it has been
+// used. It returns ErrNoRecord if the token doesn't exist or has been
+// revoked.
+func (m *TokenModel) Authenticate(token string) (*models.Token, error) {
+	if !strings.HasPrefix(token, tokenPrefix) {
+		return nil, models.ErrNoRecord
+	}
+	hash := hashToken(token)
+
+	t := &models.Token{}
+	var lastUsed mysql.NullTime
+	stmt := `SELECT id, user_id, name, scope, created, last_used FROM api_tokens
+			WHERE token_hash = ?`
+	err := m.DB.QueryRow(stmt, hash).Scan(&t.ID, &t.UserID, &t.Name, &t.Scope, &t.Created, &lastUsed)
+	if err == sql.ErrNoRows {
+		return nil, models.ErrNoRecord
+	} else if err != nil {
+		return nil, err
+	}
+	t.LastUsed = lastUsed.Time
+
+	_, err = m.DB.Exec("UPDATE api_tokens SET last_used = UTC_TIMESTAMP() WHERE id = ?", t.ID)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
@@ -0,0 +1,156 @@
+package mysql
+
+import (
+	"database/sql"
+	"strings"
+
+	"cb.net/snippetbox/pkg/models"
+)
+
+// TwoFactorModel wraps a sql.DB connection pool for users' two-factor
+// authentication settings: the TOTP secret held against each user and the
+// recovery_codes table. Like API tokens, recovery codes are only stored as
+// hashes.
+type TwoFactorModel struct {
+	DB *sql.DB
+}
+
+// normaliseRecoveryCode strips the dashes and spaces codes are shown with,
+// and ignores case, so that they can be typed in however is easiest.
+func normaliseRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// Secret returns a user's TOTP secret, or an empty string if they don't have
+// two-factor authentication turned on.
+func (m *TwoFactorModel) Secret(userID int) (string, error) {
+	var secret sql.NullString
+	err := m.DB.QueryRow("SELECT totp_secret FROM users WHERE id = ?", userID).Scan(&secret)
+	if err == sql.ErrNoRows {
+		return "", models.ErrNoRecord
+	} else if err != nil {
+		return "", err
+	}
+	return secret.String, nil
+}
+
+// Enable turns on two-factor authentication for a user with the given TOTP
+// secret, replacing any recovery codes they had with new ones. step is the
+// period of the code used to confirm the secret, which can't be used again.
+func (m *TwoFactorModel) Enable(userID int, secret string, step int64, codes []string) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE users SET totp_secret = ?, totp_last_step = ? WHERE id = ?", secret, step, userID)
+	if err != nil {
+		return err
+	}
+	if err = replaceRecoveryCodes(tx, userID, codes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Disable turns off two-factor authentication for a user and throws away
+// their recovery codes.
+func (m *TwoFactorModel) Disable(userID int) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE users SET totp_secret = NULL, totp_last_step = 0 WHERE id = ?", userID)
+	if err != nil {
+		return err
+	}
+	if err = replaceRecoveryCodes(tx, userID, nil); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ReplaceRecoveryCodes gives a user who has two-factor authentication turned
+// on a new set of recovery codes. It returns models.ErrNoRecord if they don't
+// have it turned on.
+func (m *TwoFactorModel) ReplaceRecoveryCodes(userID int, codes []string) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var secret sql.NullString
+	err = tx.QueryRow("SELECT totp_secret FROM users WHERE id = ? FOR UPDATE", userID).Scan(&secret)
+	if err == sql.ErrNoRows || (err == nil && !secret.Valid) {
+		return models.ErrNoRecord
+	} else if err != nil {
+		return err
+	}
+	if err = replaceRecoveryCodes(tx, userID, codes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// replaceRecoveryCodes deletes a user's recovery codes and stores the hashes
+// of the given ones in their place.
+func replaceRecoveryCodes(tx *sql.Tx, userID int, codes []string) error {
+	_, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID)
+	if err != nil {
+		return err
+	}
+	for _, code := range codes {
+		stmt := "INSERT INTO recovery_codes (user_id, code_hash, created) VALUES(?, ?, UTC_TIMESTAMP())"
+		_, err = tx.Exec(stmt, userID, hashToken(normaliseRecoveryCode(code)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UseStep records that a user has logged in with the TOTP code for the given
+// period. It returns models.ErrInvalidCredentials if a code from that period
+// or a later one has already been used, so that a code which has been seen
+// over someone's shoulder can't be replayed.
+func (m *TwoFactorModel) UseStep(userID int, step int64) error {
+	stmt := "UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?"
+	return oneRow(m.DB.Exec(stmt, step, userID, step))
+}
+
+// UseRecoveryCode uses up one of a user's recovery codes. It returns
+// models.ErrInvalidCredentials if the code isn't one of theirs or has
+// already been used.
+func (m *TwoFactorModel) UseRecoveryCode(userID int, code string) error {
+	stmt := `UPDATE recovery_codes SET used = UTC_TIMESTAMP()
+			WHERE user_id = ? AND code_hash = ? AND used IS NULL`
+	return oneRow(m.DB.Exec(stmt, userID, hashToken(normaliseRecoveryCode(code))))
+}
+
+// RecoveryCodesLeft returns how many of a user's recovery codes are unused.
+func (m *TwoFactorModel) RecoveryCodesLeft(userID int) (int, error) {
+	var n int
+	stmt := "SELECT COUNT(*) FROM recovery_codes WHERE user_id = ? AND used IS NULL"
+	err := m.DB.QueryRow(stmt, userID).Scan(&n)
+	return n, err
+}
+
+// oneRow turns the result of an update which should have changed exactly
+// one row into models.ErrInvalidCredentials if it changed none.
+func oneRow(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return models.ErrInvalidCredentials
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package mysql
 import (
 	"database/sql"
 	"strings"
+	"time"
 
 	"cb.net/snippetbox/pkg/models"
 
@@ -20,9 +21,9 @@ type UserModel struct {
 func (m *UserModel) Get(id int) (*models.User, error) {
 	u := &models.User{}
 	
-	stmt := `SELECT id, name, email, created, active FROM users WHERE id = ?`
+	stmt := `SELECT id, name, email, created, active, email_verified, admin FROM users WHERE id = ?`
 	
-	err := m.DB.QueryRow(stmt, id).Scan(&u.ID, &u.Name, &u.Email, &u.Created, &u.Active)
+	err := m.DB.QueryRow(stmt, id).Scan(&u.ID, &u.Name, &u.Email, &u.Created, &u.Active, &u.EmailVerified, &u.Admin)
 	if err == sql.ErrNoRows {
 		return nil, models.ErrNoRecord
 	} else if err != nil {
@@ -31,16 +32,51 @@ func (m *UserModel) Get(id int) (*models.User, error) {
 	return u, nil
 }
 
-// Insert method to add a new record to the users table.
-func (m *UserModel) Insert(name, email, password string) error {
+// GetByEmail method to fetch details for the user with the given email
+// address, whether or not their account is active or verified.
+func (m *UserModel) GetByEmail(email string) (*models.User, error) {
+	u := &models.User{}
+
+	stmt := `SELECT id, name, email, created, active, email_verified, admin FROM users WHERE email = ?`
+
+	err := m.DB.QueryRow(stmt, email).Scan(&u.ID, &u.Name, &u.Email, &u.Created, &u.Active, &u.EmailVerified, &u.Admin)
+	if err == sql.ErrNoRows {
+		return nil, models.ErrNoRecord
+	} else if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Insert method to add a new record to the users table. It returns the ID
+// of the new user. New accounts can't log in until the user has verified
+// their email address; see VerifyEmail.
+func (m *UserModel) Insert(name, email, password string) (int, error) {
+	return m.insert(name, email, password, false)
+}
+
+// InsertExternal adds a user who signs in through an external identity
+// provider, which has already verified their email address, so the account
+// can be used straight away. The user is given a random password which
+// nobody knows; they can set one with a password reset if they ever want
+// to log in without the provider.
+func (m *UserModel) InsertExternal(name, email string) (int, error) {
+	password, err := randomToken()
+	if err != nil {
+		return 0, err
+	}
+	return m.insert(name, email, password, true)
+}
+
+func (m *UserModel) insert(name, email, password string, verified bool) (int, error) {
 	// Create a bcrypt hash of the plain-text password.
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	stmt := `INSERT INTO users (name, email, hashed_password, created)
-			VALUES(?, ?, ?, UTC_TIMESTAMP())`
+	stmt := `INSERT INTO users (name, email, hashed_password, created, email_verified)
+			VALUES(?, ?, ?, UTC_TIMESTAMP(), ?)`
 	// Use the Exec() method to insert the user details and hashed password
 	// into the users table. If this returns an error, we try to type assert
 	// it to a *mysql.MySQLError object so we can check if the error number is
@@ -48,30 +84,37 @@ func (m *UserModel) Insert(name, email, password string) error {
 	// our users_uc_email key by checking the contents of the message string.
 	// If it does, we return an ErrDuplicateEmail error. Otherwise, we just
 	// return the original error (or nil if everything worked).
-	_, err = m.DB.Exec(stmt, name, email, string(hashedPassword))
+	result, err := m.DB.Exec(stmt, name, email, string(hashedPassword), verified)
 	if err != nil {
 		if mysqlErr, ok := err.(*mysql.MySQLError); ok {
 			if mysqlErr.Number == 1062 && strings.Contains(mysqlErr.Message, "users_uc_email") {
-				return models.ErrDuplicateEmail
+				return 0, models.ErrDuplicateEmail
 			}
 		}
+		return 0, err
 	}
-	return err
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(id), nil
 }
 
 // Authenticate method to verify whether a user exists with
 // the provided email address and password. This will return the relevant
 // user ID if they do.
 func (m *UserModel) Authenticate(email, password string) (int, error) {
-	// Retrieve the id and hashed password associated with the given email. If no
-	// matching email exists, or the user is not active, we return the
-	// ErrInvalidCredentials error.
+	// Retrieve the id, hashed password and verification status associated
+	// with the given email. If no matching email exists, or the user is not
+	// active, we return the ErrInvalidCredentials error.
 	var id int
 	var hashedPassword []byte
+	var verified bool
 	
-	stmt := "SELECT id, hashed_password FROM users WHERE email = ? AND active = TRUE"
+	stmt := "SELECT id, hashed_password, email_verified FROM users WHERE email = ? AND active = TRUE"
 	row := m.DB.QueryRow(stmt, email)
-	err := row.Scan(&id, &hashedPassword)
+	err := row.Scan(&id, &hashedPassword, &verified)
 	
 	if err == sql.ErrNoRows {
 		return 0, models.ErrInvalidCredentials
@@ -88,10 +131,55 @@ func (m *UserModel) Authenticate(email, password string) (int, error) {
 		return 0, err
 	}
 
+	// Only say that the address is unverified once the password has been
+	// checked, so that this can't be used to find out about accounts.
+	if !verified {
+		return 0, models.ErrUnverifiedEmail
+	}
+
 	// Otherwise, the password is correct. Return the user ID.
 	return id, nil
 }
 
+// VerifyEmail method to record that a user has verified their email
+// address. The address must still be the one that was verified. It returns
+// ErrNoRecord if there is no such unverified account. Whether the account
+// is active is left alone, so verifying can't undo a deactivation.
+func (m *UserModel) VerifyEmail(id int, email string) error {
+	stmt := "UPDATE users SET email_verified = TRUE WHERE id = ? AND email = ? AND email_verified = FALSE"
+	result, err := m.DB.Exec(stmt, id, email)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return models.ErrNoRecord
+	}
+	return nil
+}
+
+// CheckPassword method to confirm a logged in user's password before
+// something that needs it, such as turning off two-factor authentication.
+// It returns ErrInvalidCredentials if the password is wrong.
+func (m *UserModel) CheckPassword(id int, password string) error {
+	var hashedPassword []byte
+	err := m.DB.QueryRow("SELECT hashed_password FROM users WHERE id = ?", id).Scan(&hashedPassword)
+	if err == sql.ErrNoRows {
+		return models.ErrNoRecord
+	} else if err != nil {
+		return err
+	}
+
+	err = bcrypt.CompareHashAndPassword(hashedPassword, []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return models.ErrInvalidCredentials
+	}
+	return err
+}
+
 func (m *UserModel) ChangePassword(id int, currentPassword, newPassword string) error {
 	var currentHashedPassword []byte
 	row := m.DB.QueryRow("SELECT hashed_password FROM users WHERE id = ?", id)
@@ -116,3 +204,93 @@ func (m *UserModel) ChangePassword(id int, currentPassword, newPassword string)
 	_, err = m.DB.Exec(stmt, string(newHashedPassword), id)
 		return err
 }
+
+// SetPassword replaces a user's password without checking the current one,
+// for use once they have proved who they are some other way, such as with a
+// password reset token.
+func (m *UserModel) SetPassword(id int, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	if err != nil {
+		return err
+	}
+
+	// Proving who they are this way also lifts any lockout on the account.
+	stmt := `UPDATE users SET hashed_password = ?, failed_logins = 0, locked_until = NULL
+			WHERE id = ?`
+	result, err := m.DB.Exec(stmt, string(hashedPassword), id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return models.ErrNoRecord
+	}
+	return nil
+}
+
+// LoginFailures method to fetch the record of failed login attempts for the
+// account with the given email address. It returns ErrNoRecord if there is
+// no such account.
+func (m *UserModel) LoginFailures(email string) (*models.LoginFailures, error) {
+	f := &models.LoginFailures{}
+	var last, lockedUntil mysql.NullTime
+
+	stmt := `SELECT id, name, email, failed_logins, last_failed_login, locked_until
+			FROM users WHERE email = ?`
+	err := m.DB.QueryRow(stmt, email).Scan(&f.UserID, &f.Name, &f.Email, &f.Count, &last, &lockedUntil)
+	if err == sql.ErrNoRows {
+		return nil, models.ErrNoRecord
+	} else if err != nil {
+		return nil, err
+	}
+	f.Last = last.Time
+	f.LockedUntil = lockedUntil.Time
+	return f, nil
+}
+
+// RecordLoginFailure method to count a failed attempt to log in to a user's
+// account. Once there have been threshold failures in a row, the account is
+// locked for the given duration, the count starts again from zero, and it
+// returns true.
+func (m *UserModel) RecordLoginFailure(id, threshold int, lockout time.Duration) (bool, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var count int
+	err = tx.QueryRow("SELECT failed_logins FROM users WHERE id = ? FOR UPDATE", id).Scan(&count)
+	if err == sql.ErrNoRows {
+		return false, models.ErrNoRecord
+	} else if err != nil {
+		return false, err
+	}
+
+	count++
+	locked := count >= threshold
+	if locked {
+		stmt := `UPDATE users SET failed_logins = 0, last_failed_login = UTC_TIMESTAMP(),
+				locked_until = DATE_ADD(UTC_TIMESTAMP(), INTERVAL ? SECOND) WHERE id = ?`
+		_, err = tx.Exec(stmt, int(lockout/time.Second), id)
+	} else {
+		stmt := "UPDATE users SET failed_logins = ?, last_failed_login = UTC_TIMESTAMP() WHERE id = ?"
+		_, err = tx.Exec(stmt, count, id)
+	}
+	if err != nil {
+		return false, err
+	}
+	return locked, tx.Commit()
+}
+
+// ResetLoginFailures method to clear the record of failed login attempts
+// once a user has logged in successfully.
+func (m *UserModel) ResetLoginFailures(id int) error {
+	stmt := `UPDATE users SET failed_logins = 0, last_failed_login = NULL, locked_until = NULL
+			WHERE id = ? AND (failed_logins > 0 OR locked_until IS NOT NULL)`
+	_, err := m.DB.Exec(stmt, id)
+	return err
+}
@@ -0,0 +1,258 @@
+package mysql
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"cb.net/snippetbox/pkg/models"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// WebhookModel wraps a sql.DB connection pool for the webhooks and
+// webhook_deliveries tables.
+type WebhookModel struct {
+	DB *sql.DB
+}
+
+const webhookSelect = `SELECT w.id, w.user_id, w.url, w.secret, w.events, w.created FROM webhooks w`
+
+func scanWebhook(row scanner) (*models.Webhook, error) {
+	w := &models.Webhook{}
+	var events string
+	err := row.Scan(&w.ID, &w.UserID, &w.URL, &w.Secret, &events, &w.Created)
+	if err != nil {
+		return nil, err
+	}
+	w.Events = strings.Split(events, ",")
+	return w, nil
+}
+
+func (m *WebhookModel) queryWebhooks(stmt string, args ...interface{}) ([]*models.Webhook, error) {
+	rows, err := m.DB.Query(stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []*models.Webhook{}
+	for rows.Next() {
+		w, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, w)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+// Insert registers a new webhook for the user.
+func (m *WebhookModel) Insert(userID int, url, secret string, events []string) (int, error) {
+	stmt := `INSERT INTO webhooks (user_id, url, secret, events, created)
+			VALUES(?, ?, ?, ?, UTC_TIMESTAMP())`
+	result, err := m.DB.Exec(stmt, userID, url, secret, strings.Join(events, ","))
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(id), nil
+}
+
+// Get returns one of the user's webhooks, or ErrNoRecord if the user has no
+// webhook with that ID.
+func (m *WebhookModel) Get(id, userID int) (*models.Webhook, error) {
+	row := m.DB.QueryRow(webhookSelect+` WHERE w.id = ? AND w.user_id = ?`, id, userID)
+	w, err := scanWebhook(row)
+	if err == sql.ErrNoRows {
+		return nil, models.ErrNoRecord
+	}
+	return w, err
+}
+
+// ForUser returns all of the user's webhooks, oldest first.
+func (m *WebhookModel) ForUser(userID int) ([]*models.Webhook, error) {
+	return m.queryWebhooks(webhookSelect+` WHERE w.user_id = ? ORDER BY w.id`, userID)
+}
+
+// Delete removes one of the user's webhooks along with its delivery log.
+func (m *WebhookModel) Delete(id, userID int) error {
+	result, err := m.DB.Exec("DELETE FROM webhooks WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return models.ErrNoRecord
+	}
+	return nil
+}
+
+// Subscribers returns the webhooks of active users which subscribe to the
+// event and may hear about it: those belonging to ownerID, everyone's if
+// public is true, and admins' if admins is true.
+func (m *WebhookModel) Subscribers(event string, ownerID int, public, admins bool) ([]*models.Webhook, error) {
+	stmt := webhookSelect + ` JOIN users u ON u.id = w.user_id
+			WHERE FIND_IN_SET(?, w.events) AND u.active = TRUE
+			AND (w.user_id = ? OR ? OR (? AND u.admin = TRUE))`
+	return m.queryWebhooks(stmt, event, ownerID, public, admins)
+}
+
+// Enqueue adds a pending delivery of the payload to the webhook's log, due
+// to be sent straight away.
+func (m *WebhookModel) Enqueue(webhookID int, event, payload string) (int, error) {
+	stmt := `INSERT INTO webhook_deliveries (webhook_id, event, payload, created, next_attempt)
+			VALUES(?, ?, ?, UTC_TIMESTAMP(), UTC_TIMESTAMP())`
+	result, err := m.DB.Exec(stmt, webhookID, event, payload)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(id), nil
+}
+
+const deliverySelect = `SELECT d.id, d.webhook_id, d.event, d.payload, d.status, d.attempts,
+			COALESCE(d.response_code, 0), d.error, d.created, d.next_attempt, d.completed
+			FROM webhook_deliveries d`
+
+func scanDelivery(row scanner, dest ...interface{}) (*models.Delivery, error) {
+	d := &models.Delivery{}
+	var next, completed mysql.NullTime
+	err := row.Scan(append([]interface{}{&d.ID, &d.WebhookID, &d.Event, &d.Payload,
+		&d.Status, &d.Attempts, &d.ResponseCode, &d.Error, &d.Created, &next, &completed}, dest...)...)
+	if err != nil {
+		return nil, err
+	}
+	d.NextAttempt = next.Time
+	d.Completed = completed.Time
+	return d, nil
+}
+
+// Deliveries returns the most recent deliveries for one of the user's
+// webhooks, newest first.
+func (m *WebhookModel) Deliveries(webhookID, userID, limit int) ([]*models.Delivery, error) {
+	stmt := deliverySelect + ` JOIN webhooks w ON w.id = d.webhook_id
+			WHERE d.webhook_id = ? AND w.user_id = ?
+			ORDER BY d.created DESC, d.id DESC LIMIT ?`
+	rows, err := m.DB.Query(stmt, webhookID, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []*models.Delivery{}
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// Due claims up to limit pending deliveries whose next attempt is due,
+// along with their webhooks. Claimed deliveries have their next attempt
+// pushed back by lease, so that if several servers share the database each
+// delivery is only attempted by one of them at a time, and a delivery
+// abandoned by a crashed server is picked up again once its lease expires.
+func (m *WebhookModel) Due(now time.Time, limit int, lease time.Duration) ([]*models.Delivery, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	stmt := deliverySelect + `, w.user_id, w.url, w.secret
+			JOIN webhooks w ON w.id = d.webhook_id
+			WHERE d.status = 'pending' AND d.next_attempt <= ?
+			ORDER BY d.next_attempt LIMIT ? FOR UPDATE`
+	rows, err := tx.Query(stmt, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []*models.Delivery{}
+	for rows.Next() {
+		w := &models.Webhook{}
+		d, err := scanDelivery(rows, &w.UserID, &w.URL, &w.Secret)
+		if err != nil {
+			return nil, err
+		}
+		w.ID = d.WebhookID
+		d.Webhook = w
+		deliveries = append(deliveries, d)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for _, d := range deliveries {
+		_, err = tx.Exec("UPDATE webhook_deliveries SET next_attempt = ? WHERE id = ?", now.Add(lease), d.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return deliveries, tx.Commit()
+}
+
+// Record saves the outcome of an attempt to send a delivery. A delivery
+// that succeeded, or that failed and has no attempts left (indicated by a
+// zero next time), is marked as completed; otherwise it stays pending until
+// next.
+func (m *WebhookModel) Record(id, responseCode int, errMsg string, delivered bool, next time.Time) error {
+	status := models.DeliveryPending
+	switch {
+	case delivered:
+		status = models.DeliveryDelivered
+	case next.IsZero():
+		status = models.DeliveryFailed
+	}
+	if len(errMsg) > 255 {
+		errMsg = errMsg[:255]
+	}
+
+	stmt := `UPDATE webhook_deliveries SET status = ?, attempts = attempts + 1,
+			response_code = ?, error = ?, next_attempt = ?,
+			completed = IF(? = 'pending', NULL, UTC_TIMESTAMP())
+			WHERE id = ?`
+	_, err := m.DB.Exec(stmt, status, nullInt(responseCode), errMsg, nullTime(next), status, id)
+	return err
+}
+
+// Redeliver queues one of the user's deliveries to be sent again straight
+// away, with a fresh set of attempts.
+func (m *WebhookModel) Redeliver(id, webhookID, userID int) error {
+	stmt := `UPDATE webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id
+			SET d.status = 'pending', d.attempts = 0, d.next_attempt = UTC_TIMESTAMP(), d.completed = NULL
+			WHERE d.id = ? AND d.webhook_id = ? AND w.user_id = ?`
+	result, err := m.DB.Exec(stmt, id, webhookID, userID)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return models.ErrNoRecord
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidCursor is returned when a pagination cursor can't be parsed.
+var ErrInvalidCursor = errors.New("models: invalid cursor")
+
+// Cursor marks a position in a listing ordered newest first. Rows are
+// ordered by their creation time, with the ID breaking ties between rows
+// created in the same instant.
+type Cursor struct {
+	Created time.Time
+	ID      int
+}
+
+// String encodes the cursor as "<created>,<id>", with the creation time in
+// Unix nanoseconds, for use in query strings.
+func (c Cursor) String() string {
+	return fmt.Sprintf("%d,%d", c.Created.UnixNano(), c.ID)
+}
+
+// ParseCursor decodes a cursor produced by Cursor.String.
+func ParseCursor(s string) (*Cursor, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return nil, ErrInvalidCursor
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	id, err := strconv.Atoi(parts[1])
+	if err != nil || id < 1 {
+		return nil, ErrInvalidCursor
+	}
+	return &Cursor{Created: time.Unix(0, nanos).UTC(), ID: id}, nil
+}
+
+// Page requests one page of a keyset-paginated listing. With Before set the
+// page holds the rows immediately older than the cursor; with After set, the
+// rows immediately newer. With neither it starts from the newest row.
+type Page struct {
+	Before *Cursor
+	After  *Cursor
+	Limit  int
+}
+
+// SnippetPage is one page of a snippet listing. Prev points at the newer
+// neighbouring page and Next at the older one; each is nil when there is
+// nothing further in that direction.
+type SnippetPage struct {
+	Snippets []*Snippet
+	Prev     *Cursor
+	Next     *Cursor
+}
@@ -0,0 +1,84 @@
+package oidc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+)
+
+// keySet is a JSON Web Key Set, as published at a provider's jwks_uri.
+type keySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// jsonWebKey holds the members of an RSA or elliptic curve JSON Web Key
+// which are needed to check signatures.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// keys returns the set's signing keys by key ID. Keys for encryption, and
+// keys of types or curves which aren't supported, are skipped.
+func (s *keySet) keys() map[string]interface{} {
+	keys := make(map[string]interface{})
+	for _, k := range s.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if pub := k.publicKey(); pub != nil {
+			keys[k.Kid] = pub
+		}
+	}
+	return keys
+}
+
+// publicKey returns the key as an *rsa.PublicKey or *ecdsa.PublicKey, or
+// nil if it can't be used.
+func (k *jsonWebKey) publicKey() interface{} {
+	switch k.Kty {
+	case "RSA":
+		n, ok1 := decodeInt(k.N)
+		e, ok2 := decodeInt(k.E)
+		if !ok1 || !ok2 || !e.IsInt64() || n.BitLen() < 2048 {
+			return nil
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil
+		}
+		x, ok1 := decodeInt(k.X)
+		y, ok2 := decodeInt(k.Y)
+		if !ok1 || !ok2 || !curve.IsOnCurve(x, y) {
+			return nil
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+	}
+	return nil
+}
+
+// decodeInt decodes a base64url encoded big-endian integer.
+func decodeInt(s string) (*big.Int, bool) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, false
+	}
+	return new(big.Int).SetBytes(b), true
+}
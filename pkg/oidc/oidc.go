@@ -0,0 +1,387 @@
+// Package oidc implements the relying party side of OpenID Connect login
+// using the authorization code flow with PKCE: sending users to a provider
+// to sign in, exchanging the code they come back with for an ID token, and
+// checking that token's signature and claims.
+//
+// Provider endpoints and signing keys are discovered from the issuer's
+// /.well-known/openid-configuration document the first time they are
+// needed, so a provider which is down when the application starts only
+// affects logins through that provider.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// Leeway is how far the provider's clock may be out from ours before ID
+// tokens are refused as expired or not yet valid.
+const Leeway = time.Minute
+
+// maxResponseSize limits how much of any response from a provider is read.
+const maxResponseSize = 1 << 20
+
+// signingMethods are the ID token signature algorithms accepted. HMAC
+// algorithms are left out on purpose, as they would let anyone holding the
+// client secret sign tokens.
+var signingMethods = []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}
+
+// ErrInvalidToken is returned by Exchange when the provider's ID token
+// fails any of the checks made on it.
+var ErrInvalidToken = errors.New("oidc: invalid ID token")
+
+// Config describes a client registered with a provider.
+type Config struct {
+	// Issuer is the provider's issuer identifier, which must match the
+	// issuer in its discovery document and ID tokens exactly.
+	Issuer string
+	// ClientID and ClientSecret are the credentials the provider issued.
+	// Public clients, which rely on PKCE alone, have no secret.
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is where the provider sends users back to, as registered
+	// with it.
+	RedirectURL string
+	// Scopes are requested in addition to "openid".
+	Scopes []string
+}
+
+// Claims are the claims of a verified ID token which the application uses.
+type Claims struct {
+	Issuer        string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// Provider is an OpenID Connect provider. It is safe for concurrent use.
+type Provider struct {
+	config Config
+	client *http.Client
+
+	mu        sync.Mutex
+	endpoints *endpoints
+	keys      map[string]interface{}
+	fetched   time.Time
+}
+
+// endpoints holds the parts of a discovery document that are used.
+type endpoints struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// New returns a Provider for the given client configuration, which makes
+// its requests with client, or http.DefaultClient if client is nil.
+func New(config Config, client *http.Client) *Provider {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Provider{config: config, client: client}
+}
+
+// RandomString returns 256 random bits, encoded so as to be safe in URLs.
+// It is suitable for state and nonce values and for PKCE code verifiers.
+func RandomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Challenge returns the S256 PKCE code challenge for a code verifier.
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthURL returns the URL to send a user to in order to sign in with the
+// provider. The state, nonce and code verifier must be kept, usually in the
+// user's session, until they come back.
+func (p *Provider) AuthURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	e, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(e.AuthorizationEndpoint)
+	if err != nil {
+		return "", err
+	}
+	v := u.Query()
+	v.Set("response_type", "code")
+	v.Set("client_id", p.config.ClientID)
+	v.Set("redirect_uri", p.config.RedirectURL)
+	v.Set("scope", strings.Join(append([]string{"openid"}, p.config.Scopes...), " "))
+	v.Set("state", state)
+	v.Set("nonce", nonce)
+	v.Set("code_challenge", Challenge(verifier))
+	v.Set("code_challenge_method", "S256")
+	u.RawQuery = v.Encode()
+	return u.String(), nil
+}
+
+// Exchange redeems the code a user came back from the provider with, and
+// returns the claims of the ID token it is exchanged for, once the token has
+// been checked. nonce and verifier are the values passed to AuthURL.
+func (p *Provider) Exchange(ctx context.Context, code, verifier, nonce string) (*Claims, error) {
+	e, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.config.RedirectURL)
+	form.Set("code_verifier", verifier)
+	if p.config.ClientSecret == "" {
+		form.Set("client_id", p.config.ClientID)
+	}
+
+	req, err := http.NewRequest("POST", e.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.config.ClientSecret != "" {
+		// RFC 6749 section 2.3.1 has the credentials form-encoded before
+		// they go into the header.
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	var tok struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	status, err := p.do(req.WithContext(ctx), &tok)
+	if err != nil {
+		return nil, err
+	}
+	if tok.Error != "" {
+		return nil, fmt.Errorf("oidc: token request failed: %s %s", tok.Error, tok.ErrorDescription)
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("oidc: token request failed with status %d", status)
+	}
+	if tok.IDToken == "" {
+		return nil, errors.New("oidc: no ID token in token response")
+	}
+	return p.verify(ctx, tok.IDToken, nonce)
+}
+
+// idClaims are the claims checked in an ID token.
+type idClaims struct {
+	Issuer          string   `json:"iss"`
+	Subject         string   `json:"sub"`
+	Audience        audience `json:"aud"`
+	AuthorizedParty string   `json:"azp"`
+	Expires         int64    `json:"exp"`
+	IssuedAt        int64    `json:"iat"`
+	NotBefore       int64    `json:"nbf"`
+	Nonce           string   `json:"nonce"`
+	Email           string   `json:"email"`
+	EmailVerified   boolish  `json:"email_verified"`
+	Name            string   `json:"name"`
+}
+
+// Valid checks the token's times, allowing for Leeway. The other claims are
+// checked by verify, which knows what they should be.
+func (c *idClaims) Valid() error {
+	now := time.Now()
+	if c.Expires == 0 || now.After(time.Unix(c.Expires, 0).Add(Leeway)) {
+		return errors.New("token has expired")
+	}
+	if c.NotBefore != 0 && now.Add(Leeway).Before(time.Unix(c.NotBefore, 0)) {
+		return errors.New("token is not valid yet")
+	}
+	if c.IssuedAt != 0 && now.Add(Leeway).Before(time.Unix(c.IssuedAt, 0)) {
+		return errors.New("token was issued in the future")
+	}
+	return nil
+}
+
+// verify checks an ID token as section 3.1.3.7 of OpenID Connect Core
+// requires, and returns its claims.
+func (p *Provider) verify(ctx context.Context, raw, nonce string) (*Claims, error) {
+	c := &idClaims{}
+	parser := &jwt.Parser{ValidMethods: signingMethods}
+	_, err := parser.ParseWithClaims(raw, c, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.key(ctx, kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", ErrInvalidToken, err)
+	}
+
+	switch {
+	case c.Issuer != p.config.Issuer:
+		return nil, fmt.Errorf("%v: issued by %q", ErrInvalidToken, c.Issuer)
+	case !c.Audience.contains(p.config.ClientID):
+		return nil, fmt.Errorf("%v: not issued to this client", ErrInvalidToken)
+	case len(c.Audience) > 1 && c.AuthorizedParty != p.config.ClientID:
+		return nil, fmt.Errorf("%v: authorized party is %q", ErrInvalidToken, c.AuthorizedParty)
+	case c.Nonce == "" || c.Nonce != nonce:
+		return nil, fmt.Errorf("%v: nonce does not match", ErrInvalidToken)
+	case c.Subject == "":
+		return nil, fmt.Errorf("%v: no subject", ErrInvalidToken)
+	}
+
+	return &Claims{
+		Issuer:        c.Issuer,
+		Subject:       c.Subject,
+		Email:         c.Email,
+		EmailVerified: bool(c.EmailVerified),
+		Name:          c.Name,
+	}, nil
+}
+
+// discover fetches and remembers the provider's discovery document.
+func (p *Provider) discover(ctx context.Context) (*endpoints, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.endpoints != nil {
+		return p.endpoints, nil
+	}
+
+	u := strings.TrimSuffix(p.config.Issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	e := &endpoints{}
+	status, err := p.do(req.WithContext(ctx), e)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("oidc: discovery failed with status %d", status)
+	}
+	if e.Issuer != p.config.Issuer {
+		return nil, fmt.Errorf("oidc: discovery document is for issuer %q, not %q", e.Issuer, p.config.Issuer)
+	}
+	if e.AuthorizationEndpoint == "" || e.TokenEndpoint == "" || e.JWKSURI == "" {
+		return nil, errors.New("oidc: discovery document is missing endpoints")
+	}
+	p.endpoints = e
+	return e, nil
+}
+
+// key returns the provider's signing key with the given ID. The key set is
+// fetched again when a token names a key that isn't known yet, as happens
+// when the provider rotates its keys, but no more than once a minute.
+func (p *Provider) key(ctx context.Context, kid string) (interface{}, error) {
+	e, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	if time.Since(p.fetched) < time.Minute {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	req, err := http.NewRequest("GET", e.JWKSURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	set := &keySet{}
+	status, err := p.do(req.WithContext(ctx), set)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("fetching signing keys failed with status %d", status)
+	}
+	p.keys = set.keys()
+	p.fetched = time.Now()
+
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// do sends a request to the provider and decodes its JSON response into v,
+// whatever the status, which it returns.
+func (p *Provider) do(req *http.Request, v interface{}) (int, error) {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return 0, err
+	}
+	if err = json.Unmarshal(body, v); err != nil && resp.StatusCode == http.StatusOK {
+		return 0, fmt.Errorf("oidc: bad response from %s: %v", req.URL, err)
+	}
+	return resp.StatusCode, nil
+}
+
+// audience is the aud claim, which may be a single string or an array.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if json.Unmarshal(b, &s) == nil {
+		*a = audience{s}
+		return nil
+	}
+	var ss []string
+	if err := json.Unmarshal(b, &ss); err != nil {
+		return err
+	}
+	*a = audience(ss)
+	return nil
+}
+
+func (a audience) contains(s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// boolish is a boolean claim, which some providers send as a string.
+type boolish bool
+
+func (b *boolish) UnmarshalJSON(data []byte) error {
+	switch string(data) {
+	case "true", `"true"`:
+		*b = true
+	case "false", `"false"`, "null":
+		*b = false
+	default:
+		return fmt.Errorf("oidc: invalid boolean %s", data)
+	}
+	return nil
+}
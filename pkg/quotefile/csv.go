@@ -0,0 +1,82 @@
+package quotefile
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"cb.net/snippetbox/pkg/models"
+)
+
+// readCSV parses a CSV file whose first row names the columns, using the
+// names in Fields. Columns may appear in any order and any may be left out,
+// but unknown columns are an error so that typos don't silently lose data.
+func readCSV(r io.Reader) ([]*Record, error) {
+	cr := csv.NewReader(r)
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	// Spreadsheets often save CSV files with a byte order mark, which ends up
+	// at the start of the first column name.
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if !isField(name) {
+			return nil, fmt.Errorf("line 1: unknown column %q", header[i])
+		}
+		header[i] = name
+	}
+
+	var records []*Record
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		line, _ := cr.FieldPos(0)
+
+		values := url.Values{}
+		for i, name := range header {
+			values.Set(name, row[i])
+		}
+		records = append(records, &Record{Line: line, Values: values})
+	}
+	return records, nil
+}
+
+func isField(name string) bool {
+	for _, field := range Fields {
+		if name == field {
+			return true
+		}
+	}
+	return false
+}
+
+func writeCSV(w io.Writer, snippets []*models.Snippet) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(Fields); err != nil {
+		return err
+	}
+	for _, s := range snippets {
+		a := s.Author
+		if a == nil {
+			a = &models.Author{}
+		}
+		expires, expiresAt := expiryValues(s)
+		row := []string{s.Title, s.Content, a.Name, itoa(a.Born), itoa(a.Died), a.Bio,
+			s.Source, itoa(s.Year), strings.Join(s.Tags, ","), s.Visibility, expires, expiresAt}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,80 @@
+package quotefile
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"cb.net/snippetbox/pkg/models"
+)
+
+// attributionRX matches the attribution line which conventionally ends a
+// fortune, such as "\t\t-- Mark Twain".
+var attributionRX = regexp.MustCompile(`^\s*(?:--|—|―)\s*(.+?)\s*$`)
+
+// readFortune parses a fortune(6) file, in which quotes are separated by
+// lines holding a single "%". A final line starting with "--" is taken to be
+// the attribution. Fortunes have no titles, so one is made from the opening
+// words of each quote.
+func readFortune(r io.Reader) ([]*Record, error) {
+	var records []*Record
+	var lines []string
+	start := 1
+
+	flush := func() {
+		for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+			lines = lines[:len(lines)-1]
+		}
+		if len(lines) == 0 {
+			return
+		}
+
+		values := url.Values{}
+		if m := attributionRX.FindStringSubmatch(lines[len(lines)-1]); m != nil && len(lines) > 1 {
+			parseAttribution(m[1], values)
+			lines = lines[:len(lines)-1]
+		}
+		content := strings.TrimSpace(strings.Join(lines, "\n"))
+		values.Set("content", content)
+		values.Set("title", titleFor(content))
+		records = append(records, &Record{Line: start, Values: values})
+		lines = nil
+	}
+
+	sc := bufio.NewScanner(r)
+	n := 0
+	for sc.Scan() {
+		n++
+		line := strings.TrimRight(sc.Text(), "\r")
+		if line == "%" {
+			flush()
+			start = n + 1
+			continue
+		}
+		if len(lines) == 0 && strings.TrimSpace(line) == "" {
+			start = n + 1
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("line %d: %s", n+1, err)
+	}
+	flush()
+	return records, nil
+}
+
+func writeFortune(w io.Writer, snippets []*models.Snippet) error {
+	bw := bufio.NewWriter(w)
+	for _, s := range snippets {
+		fmt.Fprintln(bw, strings.TrimRight(s.Content, "\n"))
+		if a := attribution(s, false); a != "" {
+			fmt.Fprintf(bw, "\t\t-- %s\n", a)
+		}
+		fmt.Fprintln(bw, "%")
+	}
+	return bw.Flush()
+}
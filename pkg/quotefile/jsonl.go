@@ -0,0 +1,97 @@
+package quotefile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"cb.net/snippetbox/pkg/models"
+)
+
+// jsonRecord is a quote in a JSON Lines file. Its fields match those of the
+// JSON API.
+type jsonRecord struct {
+	Title      string   `json:"title"`
+	Content    string   `json:"content"`
+	Author     string   `json:"author"`
+	AuthorBorn int      `json:"author_born,omitempty"`
+	AuthorDied int      `json:"author_died,omitempty"`
+	AuthorBio  string   `json:"author_bio,omitempty"`
+	Source     string   `json:"source,omitempty"`
+	Year       int      `json:"year,omitempty"`
+	Tags       []string `json:"tags,omitempty"`
+	Visibility string   `json:"visibility,omitempty"`
+	Expires    string   `json:"expires,omitempty"`
+	ExpiresAt  string   `json:"expires_at,omitempty"`
+}
+
+// readJSONLines parses a file holding one JSON object per line. Blank lines
+// are ignored.
+func readJSONLines(r io.Reader) ([]*Record, error) {
+	var records []*Record
+	br := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		if len(bytes.TrimSpace(line)) > 0 {
+			var rec jsonRecord
+			dec := json.NewDecoder(bytes.NewReader(line))
+			dec.DisallowUnknownFields()
+			if derr := dec.Decode(&rec); derr != nil {
+				return nil, fmt.Errorf("line %d: %s", n, derr)
+			}
+
+			values := url.Values{}
+			values.Set("title", rec.Title)
+			values.Set("content", rec.Content)
+			values.Set("author", rec.Author)
+			values.Set("author_born", itoa(rec.AuthorBorn))
+			values.Set("author_died", itoa(rec.AuthorDied))
+			values.Set("author_bio", rec.AuthorBio)
+			values.Set("source", rec.Source)
+			values.Set("year", itoa(rec.Year))
+			values.Set("tags", strings.Join(rec.Tags, ","))
+			values.Set("visibility", rec.Visibility)
+			values.Set("expires", rec.Expires)
+			values.Set("expires_at", rec.ExpiresAt)
+			records = append(records, &Record{Line: n, Values: values})
+		}
+
+		if err == io.EOF {
+			return records, nil
+		}
+	}
+}
+
+func writeJSONLines(w io.Writer, snippets []*models.Snippet) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	enc.SetEscapeHTML(false)
+	for _, s := range snippets {
+		expires, expiresAt := expiryValues(s)
+		rec := jsonRecord{
+			Title:      s.Title,
+			Content:    s.Content,
+			Source:     s.Source,
+			Year:       s.Year,
+			Tags:       s.Tags,
+			Visibility: s.Visibility,
+			Expires:    expires,
+			ExpiresAt:  expiresAt,
+		}
+		if a := s.Author; a != nil {
+			rec.Author, rec.AuthorBorn, rec.AuthorDied, rec.AuthorBio = a.Name, a.Born, a.Died, a.Bio
+		}
+		if err := enc.Encode(&rec); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,89 @@
+package quotefile
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"cb.net/snippetbox/pkg/models"
+)
+
+// readMarkdown parses the Markdown written by writeMarkdown. Each quote
+// starts with a level two heading holding its title, followed by the quote
+// as a blockquote, an attribution line starting with an em dash or "--", and
+// optionally a "Tags:" line. Level one headings, horizontal rules and blank
+// lines are ignored; any other text is an error, as it would otherwise be
+// silently lost.
+func readMarkdown(r io.Reader) ([]*Record, error) {
+	var records []*Record
+	var rec *Record
+	var content []string
+
+	flush := func() {
+		if rec != nil {
+			rec.Values.Set("content", strings.TrimSpace(strings.Join(content, "\n")))
+			records = append(records, rec)
+		}
+		rec, content = nil, nil
+	}
+
+	sc := bufio.NewScanner(r)
+	n := 0
+	for sc.Scan() {
+		n++
+		line := strings.TrimRight(sc.Text(), " \t\r")
+		trimmed := strings.TrimSpace(line)
+
+		switch {
+		case strings.HasPrefix(trimmed, "## "):
+			flush()
+			rec = &Record{Line: n, Values: url.Values{}}
+			rec.Values.Set("title", strings.TrimSpace(trimmed[3:]))
+		case trimmed == "" || trimmed == "---" || strings.HasPrefix(trimmed, "# "):
+		case rec == nil:
+			return nil, fmt.Errorf("line %d: expected a \"## \" heading before the first quote", n)
+		case trimmed == ">" || strings.HasPrefix(trimmed, "> "):
+			content = append(content, strings.TrimPrefix(strings.TrimPrefix(trimmed, ">"), " "))
+		case attributionRX.MatchString(trimmed):
+			parseAttribution(attributionRX.FindStringSubmatch(trimmed)[1], rec.Values)
+		case strings.HasPrefix(strings.ToLower(trimmed), "tags:"):
+			rec.Values.Set("tags", strings.TrimSpace(trimmed[len("tags:"):]))
+		default:
+			return nil, fmt.Errorf("line %d: unexpected text %q", n, trimmed)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("line %d: %s", n+1, err)
+	}
+	flush()
+
+	// Quotes without a title line are given one, as in fortune files.
+	for _, rec := range records {
+		if rec.Values.Get("title") == "" {
+			rec.Values.Set("title", titleFor(rec.Values.Get("content")))
+		}
+	}
+	return records, nil
+}
+
+func writeMarkdown(w io.Writer, snippets []*models.Snippet) error {
+	bw := bufio.NewWriter(w)
+	for i, s := range snippets {
+		if i > 0 {
+			fmt.Fprintln(bw)
+		}
+		fmt.Fprintf(bw, "## %s\n\n", s.Title)
+		for _, line := range strings.Split(strings.TrimRight(s.Content, "\n"), "\n") {
+			fmt.Fprintln(bw, strings.TrimRight("> "+line, " "))
+		}
+		if a := attribution(s, true); a != "" {
+			fmt.Fprintf(bw, "\n— %s\n", a)
+		}
+		if len(s.Tags) > 0 {
+			fmt.Fprintf(bw, "\nTags: %s\n", strings.Join(s.Tags, ", "))
+		}
+	}
+	return bw.Flush()
+}
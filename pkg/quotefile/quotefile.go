@@ -0,0 +1,255 @@
+// Package quotefile reads and writes collections of quotes in the file
+// formats supported for import and export: fortune(6) files, CSV, JSON Lines
+// and Markdown.
+//
+// Reading a file produces records holding the same fields as the create
+// snippet form, so that imported quotes can be checked with exactly the
+// same validation rules as quotes added through the web interface.
+package quotefile
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"cb.net/snippetbox/pkg/forms"
+	"cb.net/snippetbox/pkg/models"
+)
+
+// The supported file formats.
+const (
+	Fortune   = "fortune"
+	CSV       = "csv"
+	JSONLines = "jsonl"
+	Markdown  = "markdown"
+)
+
+// Formats lists every supported format.
+var Formats = []string{Fortune, CSV, JSONLines, Markdown}
+
+// Fields are the names of the snippet form fields a record can hold, in the
+// order they appear as CSV columns.
+var Fields = []string{"title", "content", "author", "author_born", "author_died", "author_bio",
+	"source", "year", "tags", "visibility", "expires", "expires_at"}
+
+// Record is a single quote read from a file, held as form values. Line is
+// the line of the file the quote starts on, for error messages.
+type Record struct {
+	Line   int
+	Values url.Values
+}
+
+// RowError holds the validation errors for one record, keyed by field name.
+type RowError struct {
+	Line   int
+	Errors map[string][]string
+}
+
+func (e *RowError) Error() string {
+	fields := make([]string, 0, len(e.Errors))
+	for field := range e.Errors {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	msgs := make([]string, 0, len(fields))
+	for _, field := range fields {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", field, strings.Join(e.Errors[field], ", ")))
+	}
+	return fmt.Sprintf("line %d: %s", e.Line, strings.Join(msgs, "; "))
+}
+
+// ContentType returns the MIME type for files in the format.
+func ContentType(format string) string {
+	switch format {
+	case CSV:
+		return "text/csv; charset=utf-8"
+	case JSONLines:
+		return "application/x-ndjson"
+	case Markdown:
+		return "text/markdown; charset=utf-8"
+	}
+	return "text/plain; charset=utf-8"
+}
+
+// Extension returns the usual file name extension for the format.
+func Extension(format string) string {
+	switch format {
+	case CSV:
+		return ".csv"
+	case JSONLines:
+		return ".jsonl"
+	case Markdown:
+		return ".md"
+	}
+	return ".txt"
+}
+
+// FormatForFile guesses the format of a file from its name. Files with no
+// recognised extension are taken to be fortune files, which traditionally
+// have no extension at all.
+func FormatForFile(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".csv":
+		return CSV
+	case ".jsonl", ".ndjson":
+		return JSONLines
+	case ".md", ".markdown":
+		return Markdown
+	}
+	return Fortune
+}
+
+// Read parses a file in the given format. It returns an error if the file
+// is malformed; the records it returns still need to be validated, which
+// Snippets does.
+func Read(r io.Reader, format string) ([]*Record, error) {
+	switch format {
+	case Fortune:
+		return readFortune(r)
+	case CSV:
+		return readCSV(r)
+	case JSONLines:
+		return readJSONLines(r)
+	case Markdown:
+		return readMarkdown(r)
+	}
+	return nil, fmt.Errorf("quotefile: unknown format %q", format)
+}
+
+// Write writes snippets to w in the given format. Fortune and Markdown files
+// only hold a quote's wording and attribution, so other details such as
+// visibility and expiry are lost.
+func Write(w io.Writer, format string, snippets []*models.Snippet) error {
+	switch format {
+	case Fortune:
+		return writeFortune(w, snippets)
+	case CSV:
+		return writeCSV(w, snippets)
+	case JSONLines:
+		return writeJSONLines(w, snippets)
+	case Markdown:
+		return writeMarkdown(w, snippets)
+	}
+	return fmt.Errorf("quotefile: unknown format %q", format)
+}
+
+// Snippets validates each record with the same rules as the create snippet
+// form, after filling in any blank fields from defaults, and builds a
+// snippet from each. If any record is invalid it returns the errors for
+// every invalid record instead.
+func Snippets(records []*Record, defaults url.Values) ([]*models.Snippet, []*RowError) {
+	snippets := []*models.Snippet{}
+	var errs []*RowError
+	for _, rec := range records {
+		for field := range defaults {
+			if strings.TrimSpace(rec.Values.Get(field)) == "" {
+				rec.Values.Set(field, defaults.Get(field))
+			}
+		}
+
+		form := forms.New(rec.Values)
+		forms.ValidateNewSnippet(form)
+		if !form.Valid() {
+			errs = append(errs, &RowError{Line: rec.Line, Errors: form.Errors})
+			continue
+		}
+
+		s := forms.Snippet(form)
+		s.Expires = forms.ExpiryTime(form)
+		snippets = append(snippets, s)
+	}
+	if errs != nil {
+		return nil, errs
+	}
+	return snippets, nil
+}
+
+// expiryValues returns the expires and expires_at form values which
+// reproduce a snippet's expiry time.
+func expiryValues(s *models.Snippet) (string, string) {
+	if s.Expires.IsZero() {
+		return "never", ""
+	}
+	return "custom", s.Expires.UTC().Format(forms.ExpiresLayout)
+}
+
+// itoa formats an optional number, leaving zero blank.
+func itoa(n int) string {
+	if n == 0 {
+		return ""
+	}
+	return strconv.Itoa(n)
+}
+
+// maxTitle is the longest title the snippet form accepts.
+const maxTitle = 20
+
+// titleFor makes up a title for a quote from a format which has no titles,
+// from as many of the quote's first words as will fit.
+func titleFor(content string) string {
+	words := strings.Fields(content)
+	title := ""
+	for _, word := range words {
+		next := strings.TrimSpace(title + " " + word)
+		if utf8.RuneCountInString(next) > maxTitle-1 {
+			break
+		}
+		title = next
+	}
+	if title == "" && len(words) > 0 {
+		// The first word alone is too long, so cut it short.
+		title = string([]rune(words[0])[:maxTitle-1])
+	}
+	if title != strings.Join(words, " ") {
+		title = strings.TrimRight(title, ",;:") + "…"
+	}
+	return title
+}
+
+// attribution formats a snippet's author, source and year as a single line
+// such as "Mark Twain, Following the Equator, 1897", as used by fortune and
+// Markdown files.
+func attribution(s *models.Snippet, emphasise bool) string {
+	var parts []string
+	if s.Author != nil && s.Author.Name != "" {
+		parts = append(parts, s.Author.Name)
+	}
+	if s.Source != "" {
+		if emphasise {
+			parts = append(parts, "*"+s.Source+"*")
+		} else {
+			parts = append(parts, s.Source)
+		}
+	}
+	if s.Year != 0 {
+		parts = append(parts, strconv.Itoa(s.Year))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// parseAttribution is the reverse of attribution. The first part of the
+// line is the author and a trailing number is the year; anything in between
+// is the source.
+func parseAttribution(line string, values url.Values) {
+	parts := strings.Split(line, ", ")
+	if len(parts) > 1 {
+		if _, err := strconv.Atoi(parts[len(parts)-1]); err == nil {
+			values.Set("year", parts[len(parts)-1])
+			parts = parts[:len(parts)-1]
+		}
+	}
+	values.Set("author", strings.TrimSpace(parts[0]))
+	if len(parts) > 1 {
+		source := strings.TrimSpace(strings.Join(parts[1:], ", "))
+		if len(source) > 1 && (source[0] == '*' || source[0] == '_') && source[len(source)-1] == source[0] {
+			source = source[1 : len(source)-1]
+		}
+		values.Set("source", source)
+	}
+}
@@ -0,0 +1,186 @@
+package quotefile
+
+import (
+	"bytes"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"cb.net/snippetbox/pkg/models"
+)
+
+func testSnippets() []*models.Snippet {
+	return []*models.Snippet{
+		{
+			Title:      "Nine lives",
+			Content:    "A cat has nine lives.\nFor three he plays,\nfor three he strays.",
+			Author:     &models.Author{Name: "Anon", Born: 1835, Died: 1910, Bio: "Nobody knows."},
+			Source:     "Sayings, Collected",
+			Year:       1894,
+			Tags:       []string{"cats", "life"},
+			Visibility: models.VisibilityUnlisted,
+			Expires:    time.Date(2100, 1, 2, 3, 4, 0, 0, time.UTC),
+		},
+		{
+			Title:      "Brevity",
+			Content:    "Brevity is the soul of wit.",
+			Author:     &models.Author{Name: "William Shakespeare"},
+			Tags:       []string{},
+			Visibility: models.VisibilityPublic,
+		},
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	// Fortune and Markdown files only keep a quote's wording and
+	// attribution, so the rest comes back as the defaults.
+	defaults := url.Values{"visibility": {models.VisibilityPublic}, "expires": {"never"}}
+	wordingOnly := func(s *models.Snippet) {
+		s.Author = &models.Author{Name: s.Author.Name}
+		s.Visibility = models.VisibilityPublic
+		s.Expires = time.Time{}
+	}
+
+	tests := []struct {
+		format string
+		lost   func(s *models.Snippet)
+	}{
+		{CSV, func(s *models.Snippet) {}},
+		{JSONLines, func(s *models.Snippet) {}},
+		{Markdown, wordingOnly},
+		{Fortune, func(s *models.Snippet) {
+			wordingOnly(s)
+			s.Title = titleFor(s.Content)
+			s.Tags = []string{}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := Write(&buf, tt.format, testSnippets())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			records, err := Read(&buf, tt.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, errs := Snippets(records, defaults)
+			if errs != nil {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+
+			want := testSnippets()
+			for _, s := range want {
+				tt.lost(s)
+			}
+			if len(got) != len(want) {
+				t.Fatalf("want %d snippets; got %d", len(want), len(got))
+			}
+			for i := range want {
+				if !reflect.DeepEqual(got[i], want[i]) {
+					t.Errorf("snippet %d:\nwant %+v %+v\ngot  %+v %+v", i, want[i], want[i].Author, got[i], got[i].Author)
+				}
+			}
+		})
+	}
+}
+
+func TestRead(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   string
+		file     string
+		wantLine []int
+		wantErr  string
+	}{
+		{"Fortune with blank lines", Fortune, "\n\nOne\n%\n\n%\nTwo\n  -- Someone\n", []int{3, 7}, ""},
+		{"CSV with byte order mark", CSV, "\ufeffTitle,Content\nA,B\nC,D\n", []int{2, 3}, ""},
+		{"CSV with unknown column", CSV, "title,colour\nA,red\n", nil, `line 1: unknown column "colour"`},
+		{"JSON Lines with blank lines", JSONLines, "{\"title\":\"A\"}\n\n{\"title\":\"B\"}", []int{1, 3}, ""},
+		{"JSON Lines with unknown field", JSONLines, "{\"colour\":\"red\"}\n", nil, "line 1: "},
+		{"Markdown", Markdown, "# Quotes\n\n## A\n\n> B\n\n---\n\n## C\n> D\n", []int{3, 9}, ""},
+		{"Markdown without a heading", Markdown, "> B\n", nil, "line 1: expected"},
+		{"Markdown with stray text", Markdown, "## A\n\n> B\n\nstray\n", nil, `line 5: unexpected text "stray"`},
+		{"Empty", CSV, "", nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := Read(strings.NewReader(tt.file), tt.format)
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+					t.Fatalf("want error %q; got %v", tt.wantErr, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			var lines []int
+			for _, rec := range records {
+				lines = append(lines, rec.Line)
+			}
+			if !reflect.DeepEqual(lines, tt.wantLine) {
+				t.Errorf("want records on lines %v; got %v", tt.wantLine, lines)
+			}
+		})
+	}
+}
+
+func TestTitleFor(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"Empty", "", ""},
+		{"Short", "Be yourself.", "Be yourself."},
+		{"Spacing", "  Be\n yourself. ", "Be yourself."},
+		{"Cut at a word", "Brevity is the soul of wit.", "Brevity is the soul…"},
+		{"Trailing punctuation", "Well, well, well, well, well.", "Well, well, well…"},
+		{"Long first word", "Supercalifragilisticexpialidocious!", "Supercalifragilisti…"},
+		{"Counts characters", "Ça ira, ça ira, ça ira.", "Ça ira, ça ira, ça…"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := titleFor(tt.content); got != tt.want {
+				t.Errorf("want %q; got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseAttribution(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want url.Values
+	}{
+		{"Author only", "Mark Twain", url.Values{"author": {"Mark Twain"}}},
+		{"Author and year", "Mark Twain, 1897", url.Values{"author": {"Mark Twain"}, "year": {"1897"}}},
+		{"Author and source", "Mark Twain, Following the Equator",
+			url.Values{"author": {"Mark Twain"}, "source": {"Following the Equator"}}},
+		{"Everything", "Mark Twain, *Following the Equator*, 1897",
+			url.Values{"author": {"Mark Twain"}, "source": {"Following the Equator"}, "year": {"1897"}}},
+		{"Source with a comma", "Anon, Sayings, Collected, 1894",
+			url.Values{"author": {"Anon"}, "source": {"Sayings, Collected"}, "year": {"1894"}}},
+		{"Underscores", "Anon, _Sayings_", url.Values{"author": {"Anon"}, "source": {"Sayings"}}},
+		{"Number alone is an author", "1984", url.Values{"author": {"1984"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := url.Values{}
+			parseAttribution(tt.line, got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("want %v; got %v", tt.want, got)
+			}
+		})
+	}
+}
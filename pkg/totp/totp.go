@@ -0,0 +1,120 @@
+// Package totp implements the time-based one-time passwords of RFC 6238, as
+// generated by authenticator apps: six digit codes which change every 30
+// seconds, computed with HMAC-SHA1 from a secret shared when the app is set
+// up.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Digits is the length of each code, and Period how long in seconds each
+// code lasts. These are the defaults assumed by every authenticator app.
+const (
+	Digits = 6
+	Period = 30
+)
+
+// Skew is how many periods either side of the current one a code is still
+// accepted from, to allow for clocks that don't quite agree and for codes
+// typed in just as they change.
+const Skew = 1
+
+// encoding is the base32 encoding secrets are shared in: RFC 4648 without
+// padding, as authenticator apps expect.
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewSecret returns a new random 160-bit secret, base32 encoded.
+func NewSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(b), nil
+}
+
+// Step returns the number of the period t falls in.
+func Step(t time.Time) int64 {
+	return t.Unix() / Period
+}
+
+// Code returns the code for the period t falls in.
+func Code(secret string, t time.Time) (string, error) {
+	key, err := decode(secret)
+	if err != nil {
+		return "", err
+	}
+	return code(key, Step(t)), nil
+}
+
+// Validate checks a code against the periods around t, and returns the
+// number of the period it belongs to. A code is only meant to be used once,
+// so callers should remember the step and reject codes from it, or from
+// earlier periods, after that.
+func Validate(secret, input string, t time.Time) (int64, bool) {
+	key, err := decode(secret)
+	if err != nil {
+		return 0, false
+	}
+	input = strings.Replace(input, " ", "", -1)
+	if len(input) != Digits {
+		return 0, false
+	}
+
+	now := Step(t)
+	for step := now - Skew; step <= now+Skew; step++ {
+		if subtle.ConstantTimeCompare([]byte(code(key, step)), []byte(input)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// URI returns the otpauth:// URI which sets up an authenticator app with the
+// secret, usually by way of a QR code. The issuer and account name are what
+// the app shows against the codes.
+func URI(issuer, account, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(Digits))
+	v.Set("period", fmt.Sprint(Period))
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: v.Encode(),
+	}
+	return u.String()
+}
+
+// decode returns the key held in a base32 secret. Secrets typed in by hand
+// may be in lower case or broken up with spaces.
+func decode(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	return encoding.DecodeString(strings.TrimRight(secret, "="))
+}
+
+// code computes the code for a period, using the dynamic truncation of
+// RFC 4226.
+func code(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", Digits, n%1000000)
+}
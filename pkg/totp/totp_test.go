@@ -0,0 +1,101 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 key of the RFC 6238 test vectors,
+// "12345678901234567890", base32 encoded.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCode(t *testing.T) {
+	// The RFC's vectors are eight digits long; six digit codes are the last
+	// six of them.
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		t.Run(time.Unix(tt.unix, 0).UTC().Format(time.RFC3339), func(t *testing.T) {
+			got, err := Code(rfcSecret, time.Unix(tt.unix, 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("want %s; got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := Step(now)
+	code := func(offset int64) string {
+		c, err := Code(rfcSecret, now.Add(time.Duration(offset*Period)*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name     string
+		secret   string
+		input    string
+		wantStep int64
+		wantOK   bool
+	}{
+		{"Current period", rfcSecret, code(0), step, true},
+		{"Previous period", rfcSecret, code(-1), step - 1, true},
+		{"Next period", rfcSecret, code(1), step + 1, true},
+		{"Two periods ago", rfcSecret, code(-2), 0, false},
+		{"Two periods ahead", rfcSecret, code(2), 0, false},
+		{"Spaces", rfcSecret, code(0)[:3] + " " + code(0)[3:], step, true},
+		{"Lower case secret with spaces", "gezd gnbv gy3t qojq gezd gnbv gy3t qojq", code(0), step, true},
+		{"Too short", rfcSecret, code(0)[:5], 0, false},
+		{"Too long", rfcSecret, code(0) + "0", 0, false},
+		{"Wrong code", rfcSecret, "000000", 0, false},
+		{"Bad secret", "not base32!", code(0), 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotStep, ok := Validate(tt.secret, tt.input, now)
+			if ok != tt.wantOK || gotStep != tt.wantStep {
+				t.Errorf("want (%d, %v); got (%d, %v)", tt.wantStep, tt.wantOK, gotStep, ok)
+			}
+		})
+	}
+}
+
+func TestNewSecret(t *testing.T) {
+	secret, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := decode(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != 20 || strings.Contains(secret, "=") {
+		t.Errorf("want an unpadded 160-bit secret; got %q", secret)
+	}
+}
+
+func TestURI(t *testing.T) {
+	want := "otpauth://totp/Quotebox:alice@example.com?algorithm=SHA1&digits=6&issuer=Quotebox&period=30&secret=" + rfcSecret
+	if got := URI("Quotebox", "alice@example.com", rfcSecret); got != want {
+		t.Errorf("want %s; got %s", want, got)
+	}
+}
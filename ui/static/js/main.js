@@ -5,4 +5,75 @@ for (var i = 0; i < navLinks.length; i++) {
 		link.classList.add("live");
 		break;
 	}
-}
\ No newline at end of file
+}
+
+// Add newly posted quotes to the top of the home page as they arrive. Only
+// the first page of the listing asks for live updates, by naming the event
+// stream in a data-events attribute. EventSource reconnects by itself if the
+// stream drops, sending the ID of the last quote it saw so that any posted in
+// the meantime aren't missed.
+var latest = document.getElementById("latest");
+if (latest && latest.getAttribute("data-events") && window.EventSource) {
+	var seen = {};
+	var stream = new EventSource(latest.getAttribute("data-events"));
+	stream.addEventListener("snippet", function(e) {
+		var s = JSON.parse(e.data);
+		if (seen[s.id]) {
+			return;
+		}
+		seen[s.id] = true;
+
+		var table = latest.querySelector("table");
+		if (!table) {
+			table = document.createElement("table");
+			var header = table.insertRow();
+			var headings = ["Title", "Author", "Created", "ID"];
+			for (var i = 0; i < headings.length; i++) {
+				var th = document.createElement("th");
+				th.textContent = headings[i];
+				header.appendChild(th);
+			}
+			latest.innerHTML = "";
+			latest.appendChild(table);
+		}
+
+		var row = table.insertRow(1);
+		row.className = "new";
+		var title = document.createElement("a");
+		title.href = "/snippet/" + s.id;
+		title.textContent = s.title;
+		row.insertCell().appendChild(title);
+		var author = row.insertCell();
+		if (s.author) {
+			var link = document.createElement("a");
+			link.href = "/author/" + s.author.id;
+			link.textContent = s.author.name;
+			author.appendChild(link);
+		}
+		row.insertCell().textContent = s.created;
+		row.insertCell().textContent = "#" + s.id;
+	});
+	// Close the stream when leaving the page, so that the server isn't left
+	// holding it open until the next heartbeat.
+	window.addEventListener("pagehide", function() {
+		stream.close();
+	});
+}
+
+// A datetime-local input gives the expiry time as the user's own clock shows
+// it, so send the browser's offset from UTC at that time along with it for
+// the server to apply. Without script, the time is taken to be UTC, as the
+// label says.
+var expiresAt = document.querySelector("input[name='expires_at']");
+if (expiresAt) {
+	var tzOffset = expiresAt.form.querySelector("input[name='tz_offset']");
+	var tzLabel = expiresAt.form.querySelector("span.tz");
+	if (tzLabel) {
+		tzLabel.textContent = "(your local time)";
+	}
+	expiresAt.form.addEventListener("submit", function() {
+		// Date parses a date and time without a zone as local time.
+		var when = expiresAt.value ? new Date(expiresAt.value) : new Date();
+		tzOffset.value = isNaN(when) ? "" : when.getTimezoneOffset();
+	});
+}